@@ -0,0 +1,111 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// 事件类型
+const (
+	UploadCompleted   = "upload.completed"
+	TranscodeProgress = "transcode.progress"
+	VideoStatus       = "video.status"
+	VideoReady        = "video.ready"
+	VideoError        = "video.error"
+)
+
+// 每个订阅者的缓冲区大小，消费过慢时丢弃新事件
+const subscriberBuffer = 64
+
+type Event struct {
+	ID      int64     `json:"id"`
+	Type    string    `json:"type"`
+	VideoID string    `json:"videoId"`
+	Data    any       `json:"data,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// Hub 把视频生命周期事件广播给所有订阅者
+type Hub struct {
+	mu     sync.Mutex
+	nextID int64
+	subs   map[*Subscription]struct{}
+}
+
+type Subscription struct {
+	C chan Event
+
+	hub      *Hub
+	videoIDs map[string]bool
+	once     sync.Once
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		subs: make(map[*Subscription]struct{}),
+	}
+}
+
+// Subscribe 订阅事件，videoIDs 为空时接收所有视频的事件
+func (h *Hub) Subscribe(videoIDs ...string) *Subscription {
+	s := &Subscription{
+		C:   make(chan Event, subscriberBuffer),
+		hub: h,
+	}
+	if len(videoIDs) > 0 {
+		s.videoIDs = make(map[string]bool, len(videoIDs))
+		for _, id := range videoIDs {
+			s.videoIDs[id] = true
+		}
+	}
+
+	h.mu.Lock()
+	h.subs[s] = struct{}{}
+	h.mu.Unlock()
+	return s
+}
+
+// Close 取消订阅并关闭通道
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.hub.mu.Lock()
+		delete(s.hub.subs, s)
+		s.hub.mu.Unlock()
+		close(s.C)
+	})
+}
+
+// Publish 广播事件，不会因为订阅者阻塞
+func (h *Hub) Publish(eventType, videoID string, data any) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.nextID++
+	e := Event{
+		ID:      h.nextID,
+		Type:    eventType,
+		VideoID: videoID,
+		Data:    data,
+		Time:    time.Now(),
+	}
+	for s := range h.subs {
+		if s.videoIDs != nil && !s.videoIDs[videoID] {
+			continue
+		}
+		select {
+		case s.C <- e:
+		default:
+		}
+	}
+}
+
+// Default 是进程内共享的事件中心
+var Default = NewHub()
+
+func Publish(eventType, videoID string, data any) {
+	Default.Publish(eventType, videoID, data)
+}
+
+func Subscribe(videoIDs ...string) *Subscription {
+	return Default.Subscribe(videoIDs...)
+}
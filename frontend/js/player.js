@@ -72,7 +72,10 @@ class VideoPlayer {
                 throw new Error(`Video file not accessible: ${checkResponse.status}`);
             }
             
-            // 设置视频源
+            // 设置视频源，封面不存在时浏览器显示第一帧
+            this.player.poster = videoInfo.poster
+                ? videoInfo.poster.urls.large
+                : `/api/videos/${videoId}/thumbnails/poster.jpg`;
             this.player.src = videoUrl;
             this.player.load();
             
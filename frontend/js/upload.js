@@ -16,45 +16,21 @@ class VideoUploader {
         }
         
         try {
-            // 初始化上传
-            const response = await fetch('/api/upload/init', {
-                method: 'POST',
-                headers: {
-                    'Content-Type': 'application/json',
-                },
-                body: JSON.stringify({
-                    fileName: file.name,
-                    fileSize: file.size,
-                    contentType: file.type
-                })
-            });
-            
-            if (!response.ok) {
-                throw new Error('Failed to initialize upload');
-            }
+            // 同一个文件之前未完成的上传可以续传
+            const resumeKey = this.resumeKey(file);
+            const { uploadId, chunkSize, received } = await this.initOrResume(file, resumeKey);
             
-            const { uploadId, chunkSize } = await response.json();
-            
-            // 分片上传
+            // 分片上传，跳过服务器已收到的分片
             const chunks = Math.ceil(file.size / chunkSize);
             for (let i = 0; i < chunks; i++) {
+                if (received.has(i)) {
+                    this.updateProgress(((i + 1) / chunks) * 100);
+                    continue;
+                }
+                
                 const start = i * chunkSize;
                 const end = Math.min(start + chunkSize, file.size);
-                const chunk = file.slice(start, end);
-                
-                const formData = new FormData();
-                formData.append('chunk', chunk);
-                formData.append('uploadId', uploadId);
-                formData.append('chunkIndex', i);
-                
-                const chunkResponse = await fetch('/api/upload/chunk', {
-                    method: 'POST',
-                    body: formData
-                });
-                
-                if (!chunkResponse.ok) {
-                    throw new Error(`Failed to upload chunk ${i}`);
-                }
+                await this.uploadChunk(uploadId, i, file.slice(start, end));
                 
                 // 更新进度条
                 const progress = ((i + 1) / chunks) * 100;
@@ -74,8 +50,11 @@ class VideoUploader {
                 throw new Error('Failed to complete upload');
             }
             
+            // 服务端返回 202，分片在后台合并
             const result = await completeResponse.json();
-            console.log('Upload completed:', result);
+            console.log('Upload accepted:', result);
+            await this.waitForJob(result.jobId);
+            localStorage.removeItem(resumeKey);
             
             // 等待视频处理完成
             await this.waitForVideoReady(uploadId);
@@ -87,7 +66,7 @@ class VideoUploader {
                 console.error('Video list not initialized');
             }
             
-            alert('Upload completed successfully! Please restart the server to play the uploaded video.');
+            alert('Upload completed successfully!');
             
         } catch (error) {
             console.error('Upload failed:', error);
@@ -95,19 +74,133 @@ class VideoUploader {
         }
     }
     
+    resumeKey(file) {
+        return `upload:${file.name}:${file.size}:${file.lastModified}`;
+    }
+    
+    async initOrResume(file, resumeKey) {
+        const savedId = localStorage.getItem(resumeKey);
+        if (savedId) {
+            try {
+                const statusResponse = await fetch(`/api/upload/${savedId}/status`);
+                if (statusResponse.ok) {
+                    const status = await statusResponse.json();
+                    if (status.state === 'active') {
+                        console.log(`Resuming upload ${savedId}, ${status.receivedChunks.length}/${status.totalChunks} chunks received`);
+                        return {
+                            uploadId: savedId,
+                            chunkSize: status.chunkSize,
+                            received: new Set(status.receivedChunks)
+                        };
+                    }
+                }
+            } catch (error) {
+                console.warn('Failed to query upload status, starting over:', error);
+            }
+            localStorage.removeItem(resumeKey);
+        }
+        
+        // 初始化上传
+        const response = await fetch('/api/upload/init', {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json',
+            },
+            body: JSON.stringify({
+                fileName: file.name,
+                fileSize: file.size,
+                contentType: file.type
+            })
+        });
+        
+        if (!response.ok) {
+            throw new Error('Failed to initialize upload');
+        }
+        
+        const { uploadId, chunkSize } = await response.json();
+        localStorage.setItem(resumeKey, uploadId);
+        return { uploadId, chunkSize, received: new Set() };
+    }
+    
+    async chunkChecksum(chunk) {
+        // crypto.subtle 只在安全上下文（HTTPS 或 localhost）中可用
+        if (!window.crypto || !window.crypto.subtle) {
+            return null;
+        }
+        const digest = await crypto.subtle.digest('SHA-256', await chunk.arrayBuffer());
+        const hex = Array.from(new Uint8Array(digest), b => b.toString(16).padStart(2, '0')).join('');
+        return `sha256:${hex}`;
+    }
+    
+    async uploadChunk(uploadId, index, chunk, maxAttempts = 5) {
+        const checksum = await this.chunkChecksum(chunk);
+        for (let attempt = 1; ; attempt++) {
+            const formData = new FormData();
+            formData.append('chunk', chunk);
+            formData.append('uploadId', uploadId);
+            formData.append('chunkIndex', index);
+            if (checksum) {
+                formData.append('checksum', checksum);
+            }
+            
+            try {
+                const chunkResponse = await fetch('/api/upload/chunk', {
+                    method: 'POST',
+                    body: formData
+                });
+                if (chunkResponse.ok) {
+                    return;
+                }
+                // 服务器错误和校验失败（retryable）可以重试
+                const body = await chunkResponse.json().catch(() => ({}));
+                const retryable = chunkResponse.status >= 500 || body.retryable;
+                if (!retryable || attempt >= maxAttempts) {
+                    const error = new Error(`Failed to upload chunk ${index}`);
+                    error.fatal = true;
+                    throw error;
+                }
+            } catch (error) {
+                // 网络错误和服务器错误时等待后重试
+                if (error.fatal || attempt >= maxAttempts) {
+                    throw error;
+                }
+            }
+            await new Promise(resolve => setTimeout(resolve, 1000 * attempt));
+        }
+    }
+    
+    async waitForJob(jobId) {
+        while (true) {
+            const response = await fetch(`/api/jobs/${jobId}`);
+            if (!response.ok) {
+                throw new Error(`HTTP error! status: ${response.status}`);
+            }
+            
+            const job = await response.json();
+            if (job.status === 'succeeded') {
+                return job;
+            }
+            if (job.status === 'failed' || job.status === 'cancelled') {
+                throw new Error(job.error || `Job ${job.status}`);
+            }
+            await new Promise(resolve => setTimeout(resolve, 1000));
+        }
+    }
+    
     async waitForVideoReady(videoId, maxAttempts = 30) {
         console.log('Waiting for video to be ready...');
         let attempts = 0;
         
         while (attempts < maxAttempts) {
             try {
-                const response = await fetch(`/api/videos/${videoId}/info`);
+                const response = await fetch(`/api/videos/${videoId}/progress`);
                 if (!response.ok) {
                     throw new Error(`HTTP error! status: ${response.status}`);
                 }
                 
                 const videoInfo = await response.json();
-                console.log('Video status:', videoInfo.status);
+                console.log('Video status:', videoInfo.status, `${videoInfo.percent.toFixed(1)}%`);
+                this.updateTranscodeProgress(videoInfo);
                 
                 if (videoInfo.status === 'ready') {
                     console.log('Video is ready!');
@@ -131,6 +224,20 @@ class VideoUploader {
         throw new Error('Video processing timeout');
     }
     
+    updateTranscodeProgress(progress) {
+        if (progress.status !== 'processing') {
+            return;
+        }
+        this.progressBar.style.width = `${progress.percent}%`;
+        const running = progress.renditions.find(r => r.status === 'running');
+        if (running && running.eta >= 0) {
+            const pass = running.pass ? `, pass ${running.pass}/2` : '';
+            this.uploadBtn.textContent = `Transcoding ${running.rendition}${pass} (${Math.ceil(running.eta)}s left)`;
+        } else {
+            this.uploadBtn.textContent = 'Transcoding...';
+        }
+    }
+    
     updateProgress(progress) {
         this.progressBar.style.width = `${progress}%`;
         
@@ -3,6 +3,18 @@ class VideoList {
         this.videoList = document.getElementById('videoList');
         this.player = new VideoPlayer();
         this.loadVideos();
+        this.subscribeEvents();
+    }
+
+    subscribeEvents() {
+        // 视频状态变化时自动刷新列表
+        const source = new EventSource('/api/events');
+        ['upload.completed', 'video.status', 'video.ready', 'video.error'].forEach(type => {
+            source.addEventListener(type, event => {
+                console.log('Video event:', type, JSON.parse(event.data));
+                this.loadVideos();
+            });
+        });
     }
 
     async loadVideos() {
@@ -61,8 +73,14 @@ class VideoList {
 
             videoCard.innerHTML = `
                 <div class="relative aspect-w-16 aspect-h-9">
-                    <img src="/static/images/video-placeholder.png" alt="Video thumbnail"
-                         class="w-full h-full object-cover">
+                    <img src="${this.posterURL(video)}"
+                         alt="Video thumbnail" class="w-full h-full object-cover"
+                         onerror="this.onerror = null; this.src = '/static/images/video-placeholder.png'">
+                    ${video.duration ? `
+                        <span class="absolute bottom-2 right-2 px-1 rounded bg-black bg-opacity-75 text-white text-xs">
+                            ${this.formatDuration(video.duration)}
+                        </span>
+                    ` : ''}
                     ${video.status !== 'ready' ? `
                         <div class="absolute inset-0 bg-black bg-opacity-50 flex items-center justify-center">
                             <span class="text-white text-sm">${statusDisplay}</span>
@@ -85,10 +103,60 @@ class VideoList {
                 </div>
             `;
 
+            if (video.preview) {
+                this.setupPreview(videoCard, video.preview);
+            }
+
             this.videoList.appendChild(videoCard);
         });
     }
 
+    // 鼠标悬停时在封面上循环播放无声预览，移开后恢复封面
+    setupPreview(videoCard, previewURL) {
+        const container = videoCard.querySelector('.relative');
+        let preview = null;
+
+        videoCard.addEventListener('mouseenter', () => {
+            preview = document.createElement('video');
+            preview.src = previewURL;
+            preview.muted = true;
+            preview.loop = true;
+            preview.playsInline = true;
+            preview.className = 'absolute inset-0 w-full h-full object-cover';
+            container.appendChild(preview);
+            preview.play().catch(error => {
+                console.error('Preview play failed:', error);
+            });
+        });
+
+        videoCard.addEventListener('mouseleave', () => {
+            if (preview) {
+                preview.remove();
+                preview = null;
+            }
+        });
+    }
+
+    // 优先使用设置过的封面，其次是转码时自动生成的封面
+    posterURL(video) {
+        if (video.poster) {
+            return video.poster.urls.medium;
+        }
+        if (video.status === 'ready') {
+            return `/api/videos/${video.id}/thumbnails/poster.jpg`;
+        }
+        return '/static/images/video-placeholder.png';
+    }
+
+    // 把秒数格式化为 m:ss 或 h:mm:ss
+    formatDuration(seconds) {
+        const total = Math.round(seconds);
+        const h = Math.floor(total / 3600);
+        const m = Math.floor(total % 3600 / 60);
+        const s = String(total % 60).padStart(2, '0');
+        return h > 0 ? `${h}:${String(m).padStart(2, '0')}:${s}` : `${m}:${s}`;
+    }
+
     playVideo(video) {
         console.log('Playing video:', video);
         if (!video || !video.id) {
@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"video-streaming/events"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 心跳间隔，防止代理断开空闲连接
+const sseHeartbeat = 15 * time.Second
+
+// StreamEvents 通过 SSE 推送视频生命周期事件
+// 可以用 ?videoId=a&videoId=b 或 ?videoId=a,b 只订阅指定视频
+func StreamEvents(c *gin.Context) {
+	var videoIDs []string
+	for _, v := range c.QueryArray("videoId") {
+		for _, id := range strings.Split(v, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				videoIDs = append(videoIDs, id)
+			}
+		}
+	}
+
+	sub := events.Subscribe(videoIDs...)
+	defer sub.Close()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+			return true
+		case e, ok := <-sub.C:
+			if !ok {
+				return false
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				return true
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+			return true
+		}
+	})
+}
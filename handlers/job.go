@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"video-streaming/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+func GetJob(c *gin.Context) {
+	id := c.Param("id")
+	if !validateID(c, "id", id) {
+		return
+	}
+
+	job, err := models.GetJobByID(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error getting job: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get job"})
+		return
+	}
+
+	c.JSON(http.StatusOK, job)
+}
+
+func GetVideoJobs(c *gin.Context) {
+	videoID := c.Param("id")
+	if !validateID(c, "id", videoID) {
+		return
+	}
+
+	jobs, err := models.GetJobsByVideoID(videoID)
+	if err != nil {
+		log.Printf("Error getting jobs: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get jobs"})
+		return
+	}
+
+	c.JSON(http.StatusOK, jobs)
+}
+
+// CancelJob 取消仍在排队的任务，正在运行的任务不能取消
+func CancelJob(c *gin.Context) {
+	id := c.Param("id")
+	if !validateID(c, "id", id) {
+		return
+	}
+
+	job, err := models.GetJobByID(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get job"})
+		return
+	}
+
+	cancelled, err := models.CancelJob(job.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel job"})
+		return
+	}
+	if !cancelled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only queued jobs can be cancelled"})
+		return
+	}
+
+	switch job.Type {
+	case models.JobTypeTranscode:
+		// 共用该媒体的视频都在等待这个任务
+		models.UpdateMediaStatus(job.VideoID, "cancelled")
+	case models.JobTypeAssemble:
+		// 分片仍然保留，客户端可以重新提交合并
+		models.TransitionUploadSession(job.VideoID, models.UploadStateAssembling, models.UploadStateActive)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Job cancelled"})
+}
@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"video-streaming/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetLadder 返回按内容调整阶梯的试编码结果以及各清晰度配置和选择的码率
+func GetLadder(c *gin.Context) {
+	video, ok := loadVideo(c, c.Param("id"))
+	if !ok {
+		return
+	}
+
+	analysis, err := models.GetLadderAnalysis(video.StorageID())
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ladder analysis not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get ladder analysis"})
+		return
+	}
+	c.JSON(http.StatusOK, analysis)
+}
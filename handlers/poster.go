@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"video-streaming/models"
+	"video-streaming/services"
+	"video-streaming/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 上传的封面图片大小上限
+const maxPosterSize = 10 * 1024 * 1024
+
+// Posters 设置视频的封面，由 main 在启动时设置
+var Posters *services.PosterService
+
+// SetPosterFrame 从视频的指定时间点截取封面
+func SetPosterFrame(c *gin.Context) {
+	video, ok := loadVideo(c, c.Param("id"))
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Timestamp *float64 `json:"timestamp"` // 秒
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Timestamp == nil || *req.Timestamp < 0 || (video.Duration > 0 && *req.Timestamp >= video.Duration) {
+		invalidParam(c, "timestamp", "invalid_timestamp", "timestamp must be within the video duration")
+		return
+	}
+	// 从转码结果截取，转码完成前没有可用的文件
+	if video.Status != "ready" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Video is " + video.Status, "code": "video_not_ready"})
+		return
+	}
+
+	if err := Posters.SetFromFrame(c.Request.Context(), video, *req.Timestamp); err != nil {
+		log.Printf("Failed to set poster of %s from frame: %v", video.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set poster"})
+		return
+	}
+	respondPoster(c, video.ID)
+}
+
+// UploadPoster 把上传的 JPEG 或 PNG 图片设置为封面
+func UploadPoster(c *gin.Context) {
+	video, ok := loadVideo(c, c.Param("id"))
+	if !ok {
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxPosterSize+1024*1024)
+	file, header, err := c.Request.FormFile("image")
+	if err != nil {
+		invalidParam(c, "image", "missing_image", "No image file provided or image is too large")
+		return
+	}
+	defer file.Close()
+	if header.Size > maxPosterSize {
+		invalidParam(c, "image", "image_too_large", "image must not exceed 10MB")
+		return
+	}
+
+	// 先按文件头判断类型，解码检查在生成尺寸前进行
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	contentType := http.DetectContentType(head[:n])
+	if contentType != "image/jpeg" && contentType != "image/png" {
+		invalidParam(c, "image", "invalid_image", services.ErrInvalidImage.Error())
+		return
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read image"})
+		return
+	}
+
+	if err := os.MkdirAll(UploadDir, 0755); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create temp directory"})
+		return
+	}
+	tmp, err := os.CreateTemp(UploadDir, "poster-*")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create temp file"})
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, file)
+	tmp.Close()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save image"})
+		return
+	}
+
+	err = Posters.SetFromImage(c.Request.Context(), video, tmp.Name())
+	if errors.Is(err, services.ErrInvalidImage) {
+		invalidParam(c, "image", "invalid_image", err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to set poster of %s from upload: %v", video.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set poster"})
+		return
+	}
+	respondPoster(c, video.ID)
+}
+
+// respondPoster 返回视频更新后的封面
+func respondPoster(c *gin.Context, videoID string) {
+	video, err := models.GetVideoByID(videoID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get video"})
+		return
+	}
+	c.JSON(http.StatusOK, video.Poster)
+}
+
+// ServePoster 提供封面的一个尺寸
+func ServePoster(c *gin.Context) {
+	video, ok := loadVideo(c, c.Param("id"))
+	if !ok {
+		return
+	}
+
+	size := c.Param("size")
+	if !slices.ContainsFunc(models.PosterVariants, func(v models.PosterVariant) bool { return v.Name == size }) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Poster not found"})
+		return
+	}
+	info, err := Storage.Stat(c.Request.Context(), models.PosterKey(video.ID, size))
+	if errors.Is(err, storage.ErrNotExist) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Poster not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read poster"})
+		return
+	}
+
+	c.Header("Content-Type", "image/jpeg")
+	c.Header("X-Content-Type-Options", "nosniff")
+	if c.Query("v") != "" {
+		// 带版本号的地址在更换封面后会改变
+		c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		c.Header("Cache-Control", "no-cache")
+	}
+	serveObject(c, info)
+}
@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"video-streaming/models"
+	"video-streaming/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdminToken 保护 /api/admin 下的接口，为空时这些接口不可用，由 main 在启动时设置
+var AdminToken string
+
+// RequireAdmin 要求请求携带 Authorization: Bearer <AdminToken>，未设置 AdminToken 时拒绝所有请求
+func RequireAdmin(c *gin.Context) {
+	if AdminToken == "" {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Admin endpoints are disabled: ADMIN_TOKEN is not set"})
+		return
+	}
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	// 按常量时间比较，避免通过响应时间逐字节猜出令牌
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(AdminToken)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Admin token required"})
+		return
+	}
+}
+
+// lookupProfile 按名称查找上传选择的编码配置，名称为空时使用默认配置
+// 配置不存在时返回 sql.ErrNoRows
+func lookupProfile(name string) (*models.EncodingProfile, error) {
+	if name == "" {
+		return models.GetDefaultProfile()
+	}
+	return models.GetProfileByName(name)
+}
+
+// resolveProfile 为分片上传和普通上传解析 profile 参数，返回配置 ID
+func resolveProfile(c *gin.Context, name string) (string, bool) {
+	profile, err := lookupProfile(name)
+	if errors.Is(err, sql.ErrNoRows) {
+		invalidParam(c, "profile", "unknown_profile", "Unknown encoding profile "+name)
+		return "", false
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to get encoding profile"})
+		return "", false
+	}
+	return profile.ID, true
+}
+
+// loadProfile 读取路径中的编码配置，失败时已写入响应
+func loadProfile(c *gin.Context) (*models.EncodingProfile, bool) {
+	id := c.Param("id")
+	if !validateID(c, "id", id) {
+		return nil, false
+	}
+	profile, err := models.GetProfile(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Profile not found"})
+		return nil, false
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to get profile"})
+		return nil, false
+	}
+	return profile, true
+}
+
+// bindProfile 解析并校验请求中的编码配置
+func bindProfile(c *gin.Context) (*models.EncodingProfile, bool) {
+	var profile models.EncodingProfile
+	if err := c.ShouldBindJSON(&profile); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if err := services.ValidateProfile(&profile); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": "invalid_profile"})
+		return nil, false
+	}
+	return &profile, true
+}
+
+// isUniqueViolation 判断是否违反了名称唯一约束
+func isUniqueViolation(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
+
+func ListProfiles(c *gin.Context) {
+	profiles, err := models.GetProfiles()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get profiles"})
+		return
+	}
+	if profiles == nil {
+		profiles = []*models.EncodingProfile{}
+	}
+	c.JSON(http.StatusOK, profiles)
+}
+
+func GetProfile(c *gin.Context) {
+	profile, ok := loadProfile(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, profile)
+}
+
+func CreateProfile(c *gin.Context) {
+	profile, ok := bindProfile(c)
+	if !ok {
+		return
+	}
+
+	err := models.CreateProfile(profile)
+	if isUniqueViolation(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A profile named " + profile.Name + " already exists"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to create profile %s: %v", profile.Name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create profile"})
+		return
+	}
+	c.JSON(http.StatusCreated, profile)
+}
+
+// UpdateProfile 替换编码配置，只影响之后开始转码的视频
+func UpdateProfile(c *gin.Context) {
+	existing, ok := loadProfile(c)
+	if !ok {
+		return
+	}
+	profile, ok := bindProfile(c)
+	if !ok {
+		return
+	}
+	profile.ID = existing.ID
+
+	err := models.UpdateProfile(profile)
+	if isUniqueViolation(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A profile named " + profile.Name + " already exists"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to update profile %s: %v", profile.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update profile"})
+		return
+	}
+	c.JSON(http.StatusOK, profile)
+}
+
+func DeleteProfile(c *gin.Context) {
+	profile, ok := loadProfile(c)
+	if !ok {
+		return
+	}
+
+	err := models.DeleteProfile(profile.ID)
+	if errors.Is(err, models.ErrDefaultProfile) {
+		c.JSON(http.StatusConflict, gin.H{"error": "The default profile cannot be deleted; make another profile the default first"})
+		return
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete profile"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Profile deleted"})
+}
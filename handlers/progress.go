@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"video-streaming/models"
+	"video-streaming/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Progress 记录正在转码的视频的实时进度，由 main 在启动时设置
+var Progress *services.ProgressTracker
+
+func GetVideoProgress(c *gin.Context) {
+	videoID := c.Param("id")
+
+	video, err := models.GetVideoByID(videoID)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Video not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get video"})
+		return
+	}
+
+	// 复用媒体的视频显示媒体的转码进度
+	if p, ok := Progress.Get(video.StorageID()); ok {
+		c.JSON(http.StatusOK, gin.H{
+			"videoId":    videoID,
+			"status":     video.Status,
+			"duration":   p.Duration,
+			"percent":    p.Percent,
+			"renditions": p.Renditions,
+			"startedAt":  p.StartedAt,
+		})
+		return
+	}
+
+	// 没有正在进行的转码，根据视频状态给出结果
+	percent := 0.0
+	if video.Status == "ready" {
+		percent = 100
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"videoId":    videoID,
+		"status":     video.Status,
+		"percent":    percent,
+		"renditions": []*services.RenditionProgress{},
+	})
+}
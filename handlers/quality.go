@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"net/http"
+	"video-streaming/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// qualityScores 是一个清晰度的画质分数
+type qualityScores struct {
+	Rendition string `json:"rendition"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	*models.QualityScores
+}
+
+// GetQualityScores 返回视频各清晰度相对源视频的 VMAF、SSIM 和 PSNR，以及是否低于阈值
+func GetQualityScores(c *gin.Context) {
+	video, ok := loadVideo(c, c.Param("id"))
+	if !ok {
+		return
+	}
+
+	renditions := []qualityScores{}
+	flagged := []string{}
+	for _, q := range video.Qualities {
+		if q.Scores == nil {
+			continue
+		}
+		renditions = append(renditions, qualityScores{q.Resolution, q.Width, q.Height, q.Scores})
+		if q.Scores.BelowThreshold {
+			flagged = append(flagged, q.Resolution)
+		}
+	}
+	if len(renditions) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Quality scores not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"renditions":     renditions,
+		"belowThreshold": flagged,
+	})
+}
@@ -1,45 +1,42 @@
 package handlers
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
-	"os/exec"
-	"path/filepath"
+	"path"
 	"strings"
 	"video-streaming/models"
+	"video-streaming/storage"
 
 	"github.com/gin-gonic/gin"
 )
 
-const (
-	VideoDir = "./videos"
-)
-
 func StreamVideo(c *gin.Context) {
-	videoID := c.Param("id")
-	quality := c.Query("quality")
-
-	if quality == "" {
-		quality = "720p" // 默认质量
+	video, ok := loadVideo(c, c.Param("id"))
+	if !ok {
+		return
 	}
 
-	// 构建视频文件路径
-	videoPath := filepath.Join(VideoDir, videoID, quality+".mp4")
-	log.Printf("Attempting to stream video from: %s", videoPath)
+	// 只接受视频实际生成的清晰度，为空时使用默认质量
+	quality, ok := resolveQuality(c, video, c.Query("quality"))
+	if !ok {
+		return
+	}
 
-	// 检查文件是否存在且可读
-	if _, err := os.Stat(videoPath); os.IsNotExist(err) {
-		log.Printf("Video file not found: %s", videoPath)
+	// 转码时已经验证过输出文件，这里只检查文件是否存在
+	key := video.StorageID() + "/" + quality + ".mp4"
+	info, err := Storage.Stat(c.Request.Context(), key)
+	if errors.Is(err, storage.ErrNotExist) {
+		log.Printf("Video file not found: %s", key)
 		c.JSON(http.StatusNotFound, gin.H{"error": "Video not found"})
 		return
 	}
-
-	// 验证文件是否完整
-	if err := VerifyFile(videoPath); err != nil {
-		log.Printf("Video file verification failed: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Video file is not valid"})
+	if err != nil {
+		log.Printf("Failed to stat video file %s: %v", key, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read video"})
 		return
 	}
 
@@ -49,71 +46,132 @@ func StreamVideo(c *gin.Context) {
 	c.Header("Cache-Control", "no-cache")
 	c.Header("X-Content-Type-Options", "nosniff")
 
-	// 使用 http.ServeFile 来正确处理文件服务
-	http.ServeFile(c.Writer, c.Request, videoPath)
+	serveObject(c, info)
 }
 
-func GetVideoInfo(c *gin.Context) {
-	videoID := c.Param("id")
-	videoDir := filepath.Join("./videos", videoID)
+// serveObject 从存储读取对象并响应，由 http.ServeContent 处理 Range 请求
+func serveObject(c *gin.Context, info *storage.ObjectInfo) {
+	r := storage.NewReader(c.Request.Context(), Storage, info.Key, info.Size)
+	defer r.Close()
+	http.ServeContent(c.Writer, c.Request, path.Base(info.Key), info.ModTime, r)
+}
 
-	files, err := os.ReadDir(videoDir)
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Video not found"})
+// HLS 文件的 MIME 类型，fMP4 HLS 的切片与 DASH 共用
+var hlsContentTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".ts":   "video/mp2t",
+	".m4s":  "video/iso.segment",
+}
+
+// DASH 文件的 MIME 类型
+var dashContentTypes = map[string]string{
+	".mpd":  "application/dash+xml",
+	".m4s":  "video/iso.segment",
+	".m3u8": "application/vnd.apple.mpegurl",
+}
+
+// ServeHLS 提供 /api/videos/:id/hls/ 下的主播放列表、子播放列表和切片
+// 没有 MPEG-TS 打包结果时回退到 CMAF 目录中的 fMP4 HLS
+func ServeHLS(c *gin.Context) {
+	servePackageFile(c, hlsContentTypes, "hls", "cmaf")
+}
+
+// ServeDASH 提供 /api/videos/:id/dash/ 下的 MPD 清单和 CMAF 切片
+func ServeDASH(c *gin.Context) {
+	servePackageFile(c, dashContentTypes, "cmaf")
+}
+
+func servePackageFile(c *gin.Context, contentTypes map[string]string, packageDirs ...string) {
+	video, ok := loadVideo(c, c.Param("id"))
+	if !ok {
 		return
 	}
 
-	var qualities []map[string]string
-	for _, f := range files {
-		if !f.IsDir() && strings.HasSuffix(f.Name(), ".mp4") {
-			resolution := strings.TrimSuffix(f.Name(), ".mp4")
-			qualities = append(qualities, map[string]string{
-				"resolution": resolution,
-				"path":       fmt.Sprintf("/api/videos/%s/stream?quality=%s", videoID, resolution),
-			})
+	// 只允许访问打包目录内的文件
+	name := path.Clean("/" + c.Param("file"))
+	contentType, ok := contentTypes[path.Ext(name)]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+
+	// 按顺序查找第一个包含该文件的打包目录
+	var info *storage.ObjectInfo
+	for _, dir := range packageDirs {
+		candidate, err := Storage.Stat(c.Request.Context(), video.StorageID()+"/"+dir+name)
+		if err == nil {
+			info = candidate
+			break
+		}
+		if !errors.Is(err, storage.ErrNotExist) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+			return
 		}
 	}
+	if info == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"id":        videoID,
-		"title":     videoID + ".mp4",
-		"qualities": qualities,
-	})
+	c.Header("Content-Type", contentType)
+	c.Header("X-Content-Type-Options", "nosniff")
+	if strings.HasSuffix(name, ".m3u8") || strings.HasSuffix(name, ".mpd") {
+		c.Header("Cache-Control", "no-cache")
+	} else {
+		// 切片内容不会变化
+		c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	}
+
+	serveObject(c, info)
 }
 
-func getVideoInfo(videoID string) (*models.Video, error) {
-	// TODO: 从数据库获取视频信息
-	// 这里暂时返回模拟数据
-	return &models.Video{
-		ID:    videoID,
-		Title: "Sample Video",
-		Qualities: []models.Quality{
-			{Resolution: "1080p", Path: "/api/videos/" + videoID + "/stream?quality=1080p"},
-			{Resolution: "720p", Path: "/api/videos/" + videoID + "/stream?quality=720p"},
-			{Resolution: "480p", Path: "/api/videos/" + videoID + "/stream?quality=480p"},
-		},
-	}, nil
+// videoInfo 是视频详情接口的响应，hls 和 dash 只在对应的清单存在时返回
+type videoInfo struct {
+	*models.Video
+	HLS  string `json:"hls,omitempty"`
+	DASH string `json:"dash,omitempty"`
 }
 
-func verifyFile(filePath string) error {
-	// 检查文件是否存在
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		return fmt.Errorf("file does not exist")
+// GetVideoInfo 返回视频记录、各清晰度及源文件和各清晰度的技术参数
+func GetVideoInfo(c *gin.Context) {
+	video, ok := loadVideo(c, c.Param("id"))
+	if !ok {
+		return
 	}
+	if video.Qualities == nil {
+		video.Qualities = []models.Quality{}
+	}
+	info := videoInfo{Video: video}
 
-	// 使用 ffprobe 检查文件
-	cmd := exec.Command("ffprobe",
-		"-v", "error",
-		"-select_streams", "v:0",
-		"-show_entries", "stream=codec_name,width,height",
-		"-of", "json",
-		filePath,
-	)
-
-	output, err := cmd.CombinedOutput()
+	// 没有 MPEG-TS 打包结果时 HLS 使用 CMAF 目录中的播放列表
+	ctx := c.Request.Context()
+	hls, err := objectExists(ctx, video.StorageID()+"/hls/master.m3u8")
+	if err == nil && !hls {
+		hls, err = objectExists(ctx, video.StorageID()+"/cmaf/master.m3u8")
+	}
+	dash := false
+	if err == nil {
+		dash, err = objectExists(ctx, video.StorageID()+"/cmaf/manifest.mpd")
+	}
 	if err != nil {
-		return fmt.Errorf("ffprobe error: %v\nOutput: %s", err, string(output))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read video files"})
+		return
+	}
+	if hls {
+		info.HLS = fmt.Sprintf("/api/videos/%s/hls/master.m3u8", video.ID)
+	}
+	if dash {
+		info.DASH = fmt.Sprintf("/api/videos/%s/dash/manifest.mpd", video.ID)
 	}
 
-	return nil
+	c.JSON(http.StatusOK, info)
+}
+
+// objectExists 检查存储中的对象是否存在
+func objectExists(ctx context.Context, key string) (bool, error) {
+	_, err := Storage.Stat(ctx, key)
+	if errors.Is(err, storage.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
 }
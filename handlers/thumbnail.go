@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"video-streaming/services"
+	"video-streaming/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 缩略图目录中的文件类型
+var thumbnailContentTypes = map[string]string{
+	".jpg": "image/jpeg",
+	".vtt": "text/vtt",
+	".mp4": "video/mp4",
+}
+
+// GetThumbnails 返回视频的封面、WebVTT 缩略图轨道、故事板雪碧图和悬停预览地址
+func GetThumbnails(c *gin.Context) {
+	video, ok := loadVideo(c, c.Param("id"))
+	if !ok {
+		return
+	}
+
+	prefix := video.StorageID() + "/" + services.ThumbnailDir + "/"
+	objects, err := Storage.List(c.Request.Context(), prefix)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list thumbnails"})
+		return
+	}
+
+	base := fmt.Sprintf("/api/videos/%s/thumbnails/", video.ID)
+	response := gin.H{}
+	sprites := []string{}
+	for _, obj := range objects {
+		name := strings.TrimPrefix(obj.Key, prefix)
+		switch {
+		case name == services.PosterFile:
+			response["poster"] = base + name
+		case name == services.StoryboardFile:
+			response["storyboard"] = base + name
+		case name == services.PreviewFile:
+			response["preview"] = base + name
+		case strings.HasPrefix(name, "storyboard_") && strings.HasSuffix(name, ".jpg"):
+			sprites = append(sprites, base+name)
+		}
+	}
+	if len(response) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Thumbnails not found"})
+		return
+	}
+	sort.Strings(sprites)
+	response["sprites"] = sprites
+
+	c.JSON(http.StatusOK, response)
+}
+
+// ServeThumbnail 提供 /api/videos/:id/thumbnails/ 下的封面、雪碧图、WebVTT 文件和悬停预览
+func ServeThumbnail(c *gin.Context) {
+	video, ok := loadVideo(c, c.Param("id"))
+	if !ok {
+		return
+	}
+
+	// 只允许访问缩略图目录内的文件
+	name := path.Clean("/" + c.Param("file"))
+	contentType, ok := thumbnailContentTypes[path.Ext(name)]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+
+	info, err := Storage.Stat(c.Request.Context(), video.StorageID()+"/"+services.ThumbnailDir+name)
+	if errors.Is(err, storage.ErrNotExist) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+		return
+	}
+
+	// 重新转码后文件名不变，每次按修改时间重新验证
+	c.Header("Content-Type", contentType)
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Content-Type-Options", "nosniff")
+	serveObject(c, info)
+}
@@ -0,0 +1,382 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"video-streaming/models"
+	"video-streaming/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// tus 1.0 断点续传协议，见 https://tus.io/protocols/resumable-upload
+const (
+	TusVersion    = "1.0.0"
+	TusExtensions = "creation,termination,checksum,expiration"
+
+	// checksum 扩展定义的状态码
+	statusChecksumMismatch = 460
+)
+
+// 同一个上传的 PATCH 请求必须串行处理
+var tusLocks sync.Map
+
+func tusLock(id string) func() {
+	v, _ := tusLocks.LoadOrStore(id, &sync.Mutex{})
+	mu := v.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+func newTusHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case "sha1":
+		return sha1.New()
+	case "sha256":
+		return sha256.New()
+	case "md5":
+		return md5.New()
+	}
+	return nil
+}
+
+// tusHeaders 设置每个响应都需要的协议头，并检查客户端版本
+func tusHeaders(c *gin.Context) bool {
+	c.Header("Tus-Resumable", TusVersion)
+	c.Header("Cache-Control", "no-store")
+	if c.Request.Method == http.MethodOptions {
+		return true
+	}
+	if c.GetHeader("Tus-Resumable") != TusVersion {
+		c.Header("Tus-Version", TusVersion)
+		c.Status(http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+func tusError(c *gin.Context, status int, message string) {
+	c.String(status, message)
+}
+
+// parseTusMetadata 解析 Upload-Metadata 头，格式为 "key base64,key2 base64"
+func parseTusMetadata(header string) map[string]string {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			continue
+		}
+		metadata[key] = string(decoded)
+	}
+	return metadata
+}
+
+// loadTusUpload 查找 tus 上传会话，不存在或已过期时直接写入响应
+func loadTusUpload(c *gin.Context, id string) (*models.UploadSession, bool) {
+	if !isUUID(id) {
+		tusError(c, http.StatusNotFound, "Upload not found")
+		return nil, false
+	}
+	session, err := models.GetUploadSession(id)
+	if err != nil || session.Protocol != models.UploadProtocolTus {
+		tusError(c, http.StatusNotFound, "Upload not found")
+		return nil, false
+	}
+
+	switch session.State {
+	case models.UploadStateActive:
+		if session.Expired() {
+			tusError(c, http.StatusGone, "Upload expired")
+			return nil, false
+		}
+		c.Header("Upload-Expires", session.ExpiresAt.UTC().Format(http.TimeFormat))
+	case models.UploadStateAssembling, models.UploadStateCompleted:
+		// 数据已接收完整的上传不会过期
+	case models.UploadStateExpired:
+		tusError(c, http.StatusGone, "Upload expired")
+		return nil, false
+	default:
+		tusError(c, http.StatusNotFound, "Upload not found")
+		return nil, false
+	}
+	return session, true
+}
+
+// tusOffset 返回已接收的字节数
+func tusOffset(session *models.UploadSession) (int64, error) {
+	if session.State != models.UploadStateActive {
+		return session.FileSize, nil
+	}
+	info, err := os.Stat(filepath.Join(UploadDir, session.ID, services.TusDataFile))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// TusOptions 返回服务器支持的协议版本和扩展
+func TusOptions(c *gin.Context) {
+	tusHeaders(c)
+	c.Header("Tus-Version", TusVersion)
+	c.Header("Tus-Extension", TusExtensions)
+	c.Header("Tus-Checksum-Algorithm", "sha1,sha256,md5")
+	c.Status(http.StatusNoContent)
+}
+
+// TusCreate 实现 creation 扩展，创建上传和对应的视频记录
+func TusCreate(c *gin.Context) {
+	if !tusHeaders(c) {
+		return
+	}
+
+	if c.GetHeader("Upload-Defer-Length") != "" {
+		tusError(c, http.StatusBadRequest, "Upload-Defer-Length is not supported")
+		return
+	}
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		tusError(c, http.StatusBadRequest, "Invalid Upload-Length")
+		return
+	}
+
+	metadata := parseTusMetadata(c.GetHeader("Upload-Metadata"))
+	fileName := metadata["filename"]
+	if fileName == "" {
+		fileName = metadata["name"]
+	}
+	if fileName == "" {
+		fileName = "video.mp4"
+	}
+	contentType := metadata["filetype"]
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	profile, err := lookupProfile(metadata["profile"])
+	if errors.Is(err, sql.ErrNoRows) {
+		tusError(c, http.StatusBadRequest, "Unknown encoding profile")
+		return
+	}
+	if err != nil {
+		tusError(c, http.StatusInternalServerError, "Failed to get encoding profile")
+		return
+	}
+
+	uploadID := uuid.New().String()
+	uploadPath := filepath.Join(UploadDir, uploadID)
+	if err := os.MkdirAll(uploadPath, 0755); err != nil {
+		tusError(c, http.StatusInternalServerError, "Failed to create upload directory")
+		return
+	}
+	if err := os.WriteFile(filepath.Join(uploadPath, services.TusDataFile), nil, 0644); err != nil {
+		tusError(c, http.StatusInternalServerError, "Failed to create upload file")
+		return
+	}
+
+	now := time.Now()
+	video := &models.Video{
+		ID:          uploadID,
+		Title:       fileName,
+		FileName:    fileName,
+		FileSize:    length,
+		ContentType: contentType,
+		Status:      "pending",
+		ProfileID:   profile.ID,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if err := video.Save(); err != nil {
+		os.RemoveAll(uploadPath)
+		tusError(c, http.StatusInternalServerError, "Failed to save video info")
+		return
+	}
+
+	session := newUploadSession(c, video, models.UploadProtocolTus, "")
+	if err := models.CreateUploadSession(session); err != nil {
+		// 没有会话的上传无法续传也不会过期清理，删除刚创建的视频记录和目录
+		if _, err := models.DeleteVideo(uploadID); err != nil {
+			log.Printf("Failed to remove video %s: %v", uploadID, err)
+		}
+		os.RemoveAll(uploadPath)
+		tusError(c, http.StatusInternalServerError, "Failed to save upload session")
+		return
+	}
+
+	c.Header("Location", "/api/tus/"+uploadID)
+	c.Header("Upload-Expires", session.ExpiresAt.UTC().Format(http.TimeFormat))
+	c.Status(http.StatusCreated)
+}
+
+// TusHead 返回当前偏移量，客户端据此续传
+func TusHead(c *gin.Context) {
+	if !tusHeaders(c) {
+		return
+	}
+	session, ok := loadTusUpload(c, c.Param("id"))
+	if !ok {
+		return
+	}
+
+	offset, err := tusOffset(session)
+	if err != nil {
+		tusError(c, http.StatusInternalServerError, "Failed to read upload")
+		return
+	}
+
+	c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(session.FileSize, 10))
+	c.Status(http.StatusOK)
+}
+
+// TusPatch 追加数据，数据接收完整后进入和 CompleteUpload 相同的处理流程
+func TusPatch(c *gin.Context) {
+	if !tusHeaders(c) {
+		return
+	}
+	if c.ContentType() != "application/offset+octet-stream" {
+		tusError(c, http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream")
+		return
+	}
+
+	id := c.Param("id")
+	unlock := tusLock(id)
+	defer unlock()
+
+	session, ok := loadTusUpload(c, id)
+	if !ok {
+		return
+	}
+
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		tusError(c, http.StatusBadRequest, "Invalid Upload-Offset")
+		return
+	}
+	current, err := tusOffset(session)
+	if err != nil {
+		tusError(c, http.StatusInternalServerError, "Failed to read upload")
+		return
+	}
+	if offset != current || session.State != models.UploadStateActive {
+		c.Header("Upload-Offset", strconv.FormatInt(current, 10))
+		tusError(c, http.StatusConflict, "Upload-Offset does not match")
+		return
+	}
+
+	// checksum 扩展：校验本次请求的数据
+	var checksum hash.Hash
+	var expected []byte
+	if header := c.GetHeader("Upload-Checksum"); header != "" {
+		algorithm, value, _ := strings.Cut(header, " ")
+		checksum = newTusHash(algorithm)
+		if checksum == nil {
+			tusError(c, http.StatusBadRequest, "Unsupported checksum algorithm")
+			return
+		}
+		if expected, err = base64.StdEncoding.DecodeString(value); err != nil {
+			tusError(c, http.StatusBadRequest, "Invalid Upload-Checksum")
+			return
+		}
+	}
+
+	dataPath := filepath.Join(UploadDir, id, services.TusDataFile)
+	f, err := os.OpenFile(dataPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		tusError(c, http.StatusInternalServerError, "Failed to open upload file")
+		return
+	}
+
+	var w io.Writer = f
+	if checksum != nil {
+		w = io.MultiWriter(f, checksum)
+	}
+	n, copyErr := io.Copy(w, io.LimitReader(c.Request.Body, session.FileSize-current))
+
+	// 带校验的请求必须完整且正确，否则丢弃本次写入的数据
+	if checksum != nil && (copyErr != nil || !bytes.Equal(checksum.Sum(nil), expected)) {
+		f.Truncate(current)
+		f.Close()
+		c.Header("Upload-Offset", strconv.FormatInt(current, 10))
+		if copyErr != nil {
+			tusError(c, http.StatusBadRequest, "Failed to read request body")
+		} else {
+			tusError(c, statusChecksumMismatch, "Checksum Mismatch")
+		}
+		return
+	}
+	if err := f.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+
+	offset = current + n
+	c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+	if copyErr != nil {
+		// 已写入的数据保留，客户端可以通过 HEAD 获取偏移量后继续
+		log.Printf("tus upload %s interrupted at offset %d: %v", id, offset, copyErr)
+		tusError(c, http.StatusInternalServerError, "Failed to save upload data")
+		return
+	}
+
+	if offset == session.FileSize {
+		// 和分片上传一样由后台的合并任务写入存储并开始转码，请求立即返回
+		// 合并失败时会话回到 active，客户端以当前偏移量重新发送空的 PATCH 即可重试
+		if _, err := Uploads.StartAssembly(session); err != nil {
+			log.Printf("Failed to start assembly of tus upload %s: %v", id, err)
+			tusError(c, http.StatusInternalServerError, "Failed to save upload data")
+			return
+		}
+		// 上传已完成，之后的请求只会得到冲突，不再需要锁
+		tusLocks.Delete(id)
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// TusDelete 实现 termination 扩展，删除未完成的上传
+func TusDelete(c *gin.Context) {
+	if !tusHeaders(c) {
+		return
+	}
+
+	id := c.Param("id")
+	unlock := tusLock(id)
+	defer unlock()
+
+	if _, ok := loadTusUpload(c, id); !ok {
+		return
+	}
+
+	err := Uploads.Abort(id)
+	if errors.Is(err, services.ErrUploadNotActive) {
+		tusError(c, http.StatusConflict, "Upload already completed")
+		return
+	}
+	if err != nil {
+		tusError(c, http.StatusInternalServerError, "Failed to remove upload")
+		return
+	}
+	tusLocks.Delete(id)
+
+	c.Status(http.StatusNoContent)
+}
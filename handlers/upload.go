@@ -1,18 +1,21 @@
 package handlers
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
-	"sort"
+	"slices"
 	"strconv"
-	"strings"
 	"time"
 	"video-streaming/models"
 	"video-streaming/services"
+	"video-streaming/storage"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
@@ -23,11 +26,23 @@ const (
 	UploadDir = "./videos/temp"
 )
 
+// 由 main 在启动时设置
+var (
+	// Uploads 负责中止和清理上传会话
+	Uploads *services.UploadService
+	// Storage 保存原始文件和转码结果
+	Storage storage.Storage
+)
+
 func InitUpload(c *gin.Context) {
 	var uploadInfo struct {
 		FileName    string `json:"fileName"`
 		FileSize    int64  `json:"fileSize"`
 		ContentType string `json:"contentType"`
+		Checksum    string `json:"checksum"` // 可选，整个文件的 sha256:<hex> 或 crc32c:<hex>
+		Owner       string `json:"owner"`    // 可选，默认为客户端 IP
+		Mode        string `json:"mode"`     // 可选，proxy（默认）或 direct
+		Profile     string `json:"profile"`  // 可选，编码配置名称，默认使用默认配置
 	}
 
 	if err := c.ShouldBindJSON(&uploadInfo); err != nil {
@@ -35,16 +50,38 @@ func InitUpload(c *gin.Context) {
 		return
 	}
 
-	// 创建上传ID
-	uploadID := uuid.New().String()
+	if uploadInfo.FileSize <= 0 {
+		invalidParam(c, "fileSize", "invalid_file_size", "fileSize must be positive")
+		return
+	}
 
-	// 创建临时目录
-	uploadPath := filepath.Join(UploadDir, uploadID)
-	if err := os.MkdirAll(uploadPath, 0755); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload directory"})
+	var checksum *services.Checksum
+	if uploadInfo.Checksum != "" {
+		var err error
+		if checksum, err = services.ParseChecksum(uploadInfo.Checksum); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	direct := false
+	switch uploadInfo.Mode {
+	case "", models.UploadModeProxy:
+	case models.UploadModeDirect:
+		direct = true
+	default:
+		invalidParam(c, "mode", "invalid_mode", "mode must be proxy or direct")
+		return
+	}
+
+	profileID, ok := resolveProfile(c, uploadInfo.Profile)
+	if !ok {
 		return
 	}
 
+	// 创建上传ID
+	uploadID := uuid.New().String()
+
 	// 创建视频记录
 	video := &models.Video{
 		ID:          uploadID,
@@ -53,20 +90,112 @@ func InitUpload(c *gin.Context) {
 		FileSize:    uploadInfo.FileSize,
 		ContentType: uploadInfo.ContentType,
 		Status:      "pending",
+		ProfileID:   profileID,
 		CreatedAt:   time.Now(),
 		UpdatedAt:   time.Now(),
 	}
 
+	session := newUploadSession(c, video, models.UploadProtocolChunked, uploadInfo.Owner)
+	session.ChunkSize = ChunkSize
+	if checksum != nil {
+		session.Checksum = checksum.String()
+	}
+
+	uploadPath := filepath.Join(UploadDir, uploadID)
+	if direct {
+		// 分片直接上传到存储后端，分片大小受分段上传的限制
+		session.ChunkSize = services.DirectChunkSize(uploadInfo.FileSize)
+		err := Uploads.CreateDirectUpload(session)
+		if errors.Is(err, services.ErrDirectUploadUnsupported) {
+			invalidParam(c, "mode", "direct_upload_unsupported", "Storage backend does not support direct uploads")
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to create multipart upload for %s: %v", uploadID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create multipart upload"})
+			return
+		}
+	} else {
+		// 创建临时目录
+		if err := os.MkdirAll(uploadPath, 0755); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload directory"})
+			return
+		}
+	}
+	session.ChunkCount = int((uploadInfo.FileSize + session.ChunkSize - 1) / session.ChunkSize)
+
+	// 没有会话记录的上传不会被过期清理，保存失败时立即放弃分段上传或删除临时目录
+	cleanup := func() {
+		if !direct {
+			os.RemoveAll(uploadPath)
+			return
+		}
+		if err := Uploads.CancelDirectUpload(session); err != nil {
+			log.Printf("Failed to abort multipart upload %s: %v", uploadID, err)
+		}
+	}
+
 	// 保存到数据库
 	if err := video.Save(); err != nil {
+		cleanup()
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save video info"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
+	// 记录上传会话
+	if err := models.CreateUploadSession(session); err != nil {
+		if _, err := models.DeleteVideo(uploadID); err != nil {
+			log.Printf("Failed to remove video %s: %v", uploadID, err)
+		}
+		cleanup()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save upload session"})
+		return
+	}
+
+	response := gin.H{
 		"uploadId":  uploadID,
-		"chunkSize": ChunkSize,
-	})
+		"mode":      session.Mode,
+		"chunkSize": session.ChunkSize,
+		"expiresAt": session.ExpiresAt,
+	}
+	if direct {
+		// 客户端把分片 PUT 到对应的 parts[].url，完成后调用 /upload/complete
+		// 只返回第一批分片的 URL，其余的通过上传状态接口获取
+		indices := make([]int, min(session.ChunkCount, services.PartURLBatch))
+		for i := range indices {
+			indices[i] = i
+		}
+		parts, err := Uploads.PresignChunks(session, indices)
+		if err != nil {
+			log.Printf("Failed to presign parts for upload %s: %v", uploadID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to presign part URLs"})
+			return
+		}
+		response["parts"] = parts
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// newUploadSession 为刚创建的视频记录生成上传会话
+func newUploadSession(c *gin.Context, video *models.Video, protocol, owner string) *models.UploadSession {
+	if owner == "" {
+		owner = c.ClientIP()
+	}
+	now := time.Now()
+	return &models.UploadSession{
+		ID:        video.ID,
+		VideoID:   video.ID,
+		Protocol:  protocol,
+		FileName:  video.FileName,
+		FileSize:  video.FileSize,
+		Mode:      models.UploadModeProxy,
+		Owner:     owner,
+		State:     models.UploadStateActive,
+		CreatedAt: now,
+		UpdatedAt: now,
+		ExpiresAt: now.Add(services.UploadSessionTTL),
+	}
 }
 
 func UploadChunk(c *gin.Context) {
@@ -78,238 +207,249 @@ func UploadChunk(c *gin.Context) {
 		return
 	}
 
+	session, ok := loadUploadSession(c, uploadID)
+	if !ok {
+		return
+	}
+	if session.Mode == models.UploadModeDirect {
+		invalidParam(c, "uploadId", "direct_upload", "Chunks of this upload must be uploaded to the presigned part URLs")
+		return
+	}
+	index, ok := parseChunkIndex(c, session, chunkIndex)
+	if !ok {
+		return
+	}
+
+	// 可选的分片校验值
+	var checksum *services.Checksum
+	if value := c.PostForm("checksum"); value != "" {
+		var err error
+		if checksum, err = services.ParseChecksum(value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
 	// 获取上传的文件
-	file, _, err := c.Request.FormFile("chunk")
+	file, header, err := c.Request.FormFile("chunk")
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to get chunk file"})
 		return
 	}
 	defer file.Close()
 
-	// 创建分片文件
-	chunkPath := filepath.Join(UploadDir, uploadID, fmt.Sprintf("chunk_%s", chunkIndex))
-	chunkFile, err := os.Create(chunkPath)
+	if expected := services.ExpectedChunkSize(session, index); header.Size != expected {
+		invalidParam(c, "chunk", "invalid_chunk_size",
+			fmt.Sprintf("chunk %d must be %d bytes, got %d", index, expected, header.Size))
+		return
+	}
+
+	// 先写入临时文件，写完后再重命名，断线时不会留下不完整的分片
+	chunkPath := filepath.Join(UploadDir, session.ID, fmt.Sprintf("chunk_%d", index))
+	partPath := chunkPath + ".part"
+	chunkFile, err := os.Create(partPath)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create chunk file"})
 		return
 	}
-	defer chunkFile.Close()
 
-	// 保存分片
-	if _, err := io.Copy(chunkFile, file); err != nil {
+	// 保存分片，同时计算校验值
+	var w io.Writer = chunkFile
+	var h hash.Hash
+	if checksum != nil {
+		h = checksum.NewHash()
+		w = io.MultiWriter(chunkFile, h)
+	}
+	_, err = io.Copy(w, file)
+	chunkFile.Close()
+	if err != nil {
+		os.Remove(partPath)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save chunk"})
+		return
+	}
+	if checksum != nil && !checksum.Matches(h) {
+		os.Remove(partPath)
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error":      "Chunk checksum mismatch",
+			"code":       "checksum_mismatch",
+			"chunkIndex": index,
+			"retryable":  true,
+		})
+		return
+	}
+	if err := os.Rename(partPath, chunkPath); err != nil {
+		os.Remove(partPath)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save chunk"})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"message":    "Chunk uploaded successfully",
-		"chunkIndex": chunkIndex,
+		"chunkIndex": index,
 	})
 }
 
-func CompleteUpload(c *gin.Context) {
-	var completeInfo struct {
-		UploadID string `json:"uploadId"`
+// GetUploadStatus 返回已收到的分片，客户端据此续传
+// 直传时还返回缺失分片的下一批上传 URL，from 指定从哪个分片开始
+func GetUploadStatus(c *gin.Context) {
+	uploadID := c.Param("uploadId")
+	if !validateID(c, "uploadId", uploadID) {
+		return
 	}
-
-	if err := c.ShouldBindJSON(&completeInfo); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	from, err := strconv.Atoi(c.DefaultQuery("from", "0"))
+	if err != nil || from < 0 {
+		invalidParam(c, "from", "invalid_chunk_index", "from must be a non-negative chunk index")
 		return
 	}
 
-	tempDir := filepath.Join(UploadDir, completeInfo.UploadID)
-	outputDir := filepath.Join("./videos", completeInfo.UploadID)
-
-	// 确保输出目录存在
-	if err := os.MkdirAll(outputDir, 0755); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create output directory"})
+	session, err := models.GetUploadSession(uploadID)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
 		return
 	}
-
-	outputFile := filepath.Join(outputDir, "original.mp4")
-
-	// 创建输出文件
-	out, err := os.Create(outputFile)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create output file"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get upload"})
 		return
 	}
-	defer out.Close()
 
-	// 读取所有分片并排序
-	files, err := os.ReadDir(tempDir)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read temp directory"})
-		return
+	response := gin.H{
+		"uploadId":       uploadID,
+		"state":          session.State,
+		"mode":           session.Mode,
+		"fileSize":       session.FileSize,
+		"chunkSize":      session.ChunkSize,
+		"totalChunks":    session.ChunkCount,
+		"receivedChunks": []int{},
+		"receivedBytes":  0,
+		"chunks":         []services.ChunkInfo{},
+		"expiresAt":      session.ExpiresAt,
 	}
 
-	var chunkFiles []string
-	for _, f := range files {
-		if !f.IsDir() && strings.HasPrefix(f.Name(), "chunk_") {
-			chunkFiles = append(chunkFiles, f.Name())
+	// 只有进行中和合并中的上传才有分片，直传的分段在合并开始后可能已经不存在
+	direct := session.Mode == models.UploadModeDirect
+	switch {
+	case session.State == models.UploadStateActive:
+	case session.State == models.UploadStateAssembling && !direct:
+	default:
+		if session.State == models.UploadStateCompleted || session.State == models.UploadStateAssembling {
+			response["receivedBytes"] = session.FileSize
 		}
+		c.JSON(http.StatusOK, response)
+		return
 	}
 
-	// 按 chunk_数字 排序
-	sort.Slice(chunkFiles, func(i, j int) bool {
-		a, _ := strconv.Atoi(strings.TrimPrefix(chunkFiles[i], "chunk_"))
-		b, _ := strconv.Atoi(strings.TrimPrefix(chunkFiles[j], "chunk_"))
-		return a < b
-	})
+	chunks, err := Uploads.ListChunks(session)
+	if err != nil && !os.IsNotExist(err) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list uploaded chunks"})
+		return
+	}
 
-	// 合并分片
-	for _, fname := range chunkFiles {
-		chunkPath := filepath.Join(tempDir, fname)
-		chunkData, err := os.ReadFile(chunkPath)
+	received := make([]int, 0, len(chunks))
+	var receivedBytes int64
+	for _, chunk := range chunks {
+		received = append(received, chunk.Index)
+		receivedBytes += chunk.Size
+	}
+	response["receivedChunks"] = received
+	response["receivedBytes"] = receivedBytes
+	if chunks != nil {
+		response["chunks"] = chunks
+	}
+
+	// 直传的客户端需要缺失分片的 URL，一次最多返回一批
+	if direct && !session.Expired() {
+		missing, _ := services.MissingChunks(session, chunks)
+		missing = slices.DeleteFunc(missing, func(index int) bool { return index < from })
+		parts, err := Uploads.PresignChunks(session, missing[:min(len(missing), services.PartURLBatch)])
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read chunk"})
-			return
-		}
-		if _, err := out.Write(chunkData); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write chunk"})
+			log.Printf("Failed to presign parts for upload %s: %v", uploadID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to presign part URLs"})
 			return
 		}
-		// 删除已处理的分片文件
-		os.Remove(chunkPath)
+		response["parts"] = parts
 	}
 
-	// 关闭文件句柄
-	out.Close()
+	c.JSON(http.StatusOK, response)
+}
 
-	// 验证文件是否完整
-	if err := VerifyFile(outputFile); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "File verification failed: " + err.Error()})
+// AbortUpload 中止进行中的上传，删除已上传的分片
+func AbortUpload(c *gin.Context) {
+	uploadID := c.Param("uploadId")
+	if !validateID(c, "uploadId", uploadID) {
 		return
 	}
 
-	// 更新视频状态为 processing
-	if err := models.UpdateVideoStatus(completeInfo.UploadID, "processing"); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update video status"})
+	err := Uploads.Abort(uploadID)
+	if errors.Is(err, services.ErrUploadNotActive) {
+		invalidParam(c, "uploadId", "upload_not_active", "Upload is not active")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to abort upload %s: %v", uploadID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to abort upload"})
 		return
 	}
 
-	// 开始转码
-	go func() {
-		transcodeService := services.NewTranscodeService("./videos")
-		if err := transcodeService.TranscodeVideo(completeInfo.UploadID); err != nil {
-			log.Printf("Transcoding failed for upload %s: %v", completeInfo.UploadID, err)
-			models.UpdateVideoStatus(completeInfo.UploadID, "error")
-			return
-		}
-
-		// 验证转码后的文件
-		if err := VerifyTranscodedFiles(completeInfo.UploadID); err != nil {
-			log.Printf("Transcoded files verification failed for %s: %v", completeInfo.UploadID, err)
-			models.UpdateVideoStatus(completeInfo.UploadID, "error")
-			return
-		}
-
-		models.UpdateVideoStatus(completeInfo.UploadID, "ready")
-
-		// 清理临时目录
-		if err := os.RemoveAll(tempDir); err != nil {
-			log.Printf("Failed to remove temp directory %s: %v", tempDir, err)
-		}
-	}()
-
-	c.JSON(http.StatusOK, gin.H{
-		"message": "Upload completed, transcoding started",
-	})
+	c.JSON(http.StatusOK, gin.H{"message": "Upload aborted"})
 }
 
-func UploadVideo(c *gin.Context) {
-	// 确保目录存在
-	if err := os.MkdirAll(UploadDir, 0755); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create temp directory"})
-		return
+// CompleteUpload 检查分片齐全后把合并放到后台执行，立即返回 202 和任务 ID
+func CompleteUpload(c *gin.Context) {
+	var completeInfo struct {
+		UploadID string `json:"uploadId"`
 	}
 
-	// 获取上传的文件
-	file, header, err := c.Request.FormFile("video")
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "No video file provided"})
+	if err := c.ShouldBindJSON(&completeInfo); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	defer file.Close()
 
-	// 创建临时文件
-	tempFile := filepath.Join(UploadDir, header.Filename)
-	out, err := os.Create(tempFile)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create temp file"})
+	session, ok := loadUploadSession(c, completeInfo.UploadID)
+	if !ok {
 		return
 	}
-	defer out.Close()
 
-	// 保存文件
-	_, err = io.Copy(out, file)
+	chunks, err := Uploads.ListChunks(session)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list uploaded chunks"})
 		return
 	}
 
-	// 创建视频记录
-	video := &models.Video{
-		Title:       header.Filename,
-		FileName:    header.Filename,
-		FileSize:    header.Size,
-		ContentType: header.Header.Get("Content-Type"),
-		Status:      "processing",
+	// 检查分片是否齐全，避免把缺失或截断的上传合并
+	missing, received := services.MissingChunks(session, chunks)
+	if len(missing) > 0 || received != session.FileSize {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":         "Upload is incomplete",
+			"code":          "incomplete_upload",
+			"missingChunks": missing,
+			"receivedBytes": received,
+			"fileSize":      session.FileSize,
+		})
+		return
 	}
-
-	if err := models.CreateVideo(video); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create video record"})
+	if invalid := services.InvalidChunks(session, chunks); len(invalid) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":         "Some chunks have the wrong size",
+			"code":          "invalid_chunk_size",
+			"invalidChunks": invalid,
+		})
 		return
 	}
 
-	// 启动转码
-	go func() {
-		if err := services.TranscodeVideo(video.ID, tempFile); err != nil {
-			fmt.Printf("Transcoding failed: %v\n", err)
-			// 更新视频状态为失败
-			video.Status = "failed"
-			models.UpdateVideo(video)
-			return
-		}
-		// 更新视频状态为完成
-		video.Status = "ready"
-		models.UpdateVideo(video)
-	}()
-
-	c.JSON(http.StatusOK, gin.H{
-		"message": "Video upload started",
-		"videoId": video.ID,
-	})
-}
-
-func fileExists(path string) bool {
-	_, err := os.Stat(path)
-	return err == nil
-}
-
-func CleanInvalidVideos() error {
-	rows, err := models.DB.Query(`SELECT id FROM videos`)
+	job, err := Uploads.StartAssembly(session)
+	if errors.Is(err, services.ErrUploadNotActive) {
+		invalidParam(c, "uploadId", "upload_not_active", "Upload is not active")
+		return
+	}
 	if err != nil {
-		return err
+		log.Printf("Failed to start assembly for upload %s: %v", session.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start assembly"})
+		return
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var id string
-		if err := rows.Scan(&id); err != nil {
-			continue
-		}
-		videoDir := "./videos/" + id
-		found := false
-		for _, res := range []string{"1080p.mp4", "720p.mp4", "480p.mp4"} {
-			if fileExists(videoDir + "/" + res) {
-				found = true
-				break
-			}
-		}
-		if !found {
-			models.DB.Exec(`DELETE FROM videos WHERE id = ?`, id)
-		}
-	}
-	return nil
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":  "Upload accepted, assembling",
+		"uploadId": session.ID,
+		"jobId":    job.ID,
+	})
 }
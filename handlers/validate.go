@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"video-streaming/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// 旧版本转码时没有记录清晰度，按默认清晰度处理
+var defaultRenditions = []string{"1080p", "720p", "480p"}
+
+// invalidParam 返回结构化的 400 错误
+func invalidParam(c *gin.Context, field, code, message string) {
+	c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+		"error": message,
+		"code":  code,
+		"field": field,
+	})
+}
+
+// isUUID 只接受标准的小写 UUID 格式，防止 ID 被用来拼接路径
+func isUUID(s string) bool {
+	u, err := uuid.Parse(s)
+	return err == nil && u.String() == s
+}
+
+// validateID 检查路径或表单中的 ID 参数
+func validateID(c *gin.Context, field, value string) bool {
+	if !isUUID(value) {
+		invalidParam(c, field, "invalid_id", field+" must be a UUID")
+		return false
+	}
+	return true
+}
+
+// loadUploadSession 返回仍在进行中的分片上传会话
+func loadUploadSession(c *gin.Context, uploadID string) (*models.UploadSession, bool) {
+	if !validateID(c, "uploadId", uploadID) {
+		return nil, false
+	}
+
+	session, err := models.GetUploadSession(uploadID)
+	if errors.Is(err, sql.ErrNoRows) {
+		invalidParam(c, "uploadId", "unknown_upload", "Upload not found")
+		return nil, false
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to get upload"})
+		return nil, false
+	}
+	if session.Protocol != models.UploadProtocolChunked {
+		invalidParam(c, "uploadId", "wrong_protocol", "Upload was created with the "+session.Protocol+" protocol")
+		return nil, false
+	}
+	if session.State != models.UploadStateActive {
+		invalidParam(c, "uploadId", "upload_not_active", "Upload is already "+session.State)
+		return nil, false
+	}
+	if session.Expired() {
+		invalidParam(c, "uploadId", "upload_expired", "Upload has expired")
+		return nil, false
+	}
+	return session, true
+}
+
+// loadVideo 检查视频 ID 并从数据库读取视频
+func loadVideo(c *gin.Context, videoID string) (*models.Video, bool) {
+	if !validateID(c, "id", videoID) {
+		return nil, false
+	}
+
+	video, err := models.GetVideoByID(videoID)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Video not found"})
+		return nil, false
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to get video"})
+		return nil, false
+	}
+	return video, true
+}
+
+// parseChunkIndex 检查分片序号是十进制数字且在声明的分片数量之内
+func parseChunkIndex(c *gin.Context, session *models.UploadSession, value string) (int, bool) {
+	for _, r := range value {
+		if r < '0' || r > '9' {
+			invalidParam(c, "chunkIndex", "invalid_chunk_index", "chunkIndex must be a non-negative integer")
+			return 0, false
+		}
+	}
+	index, err := strconv.Atoi(value)
+	if err != nil || value == "" {
+		invalidParam(c, "chunkIndex", "invalid_chunk_index", "chunkIndex must be a non-negative integer")
+		return 0, false
+	}
+	if index >= session.ChunkCount {
+		invalidParam(c, "chunkIndex", "chunk_index_out_of_range",
+			"chunkIndex must be less than "+strconv.Itoa(session.ChunkCount))
+		return 0, false
+	}
+	return index, true
+}
+
+// videoRenditions 返回视频实际生成的清晰度名称
+func videoRenditions(video *models.Video) []string {
+	if len(video.Qualities) == 0 {
+		return defaultRenditions
+	}
+	names := make([]string, len(video.Qualities))
+	for i, q := range video.Qualities {
+		names[i] = q.Resolution
+	}
+	return names
+}
+
+// resolveQuality 检查 quality 是视频的一个清晰度，为空时选择默认清晰度
+func resolveQuality(c *gin.Context, video *models.Video, quality string) (string, bool) {
+	renditions := videoRenditions(video)
+	if quality == "" {
+		for _, name := range renditions {
+			if name == "720p" {
+				return name, true
+			}
+		}
+		return renditions[0], true
+	}
+
+	for _, name := range renditions {
+		if name == quality {
+			return name, true
+		}
+	}
+	invalidParam(c, "quality", "unknown_quality", "quality must be one of the video's renditions")
+	return "", false
+}
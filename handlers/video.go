@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"strconv"
 	"video-streaming/models"
+	"video-streaming/storage"
 
 	"log"
 
@@ -33,3 +34,43 @@ func GetVideoList(c *gin.Context) {
 
 	c.JSON(http.StatusOK, videos)
 }
+
+// DeleteVideo 删除视频记录，文件只在没有其他视频引用同一媒体时删除
+func DeleteVideo(c *gin.Context) {
+	video, ok := loadVideo(c, c.Param("id"))
+	if !ok {
+		return
+	}
+
+	// 上传中的视频通过中止上传删除，转码中的视频等转码结束后再删除
+	if video.Status == "pending" || video.Status == "processing" {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "Video is " + video.Status,
+			"code":  "video_busy",
+		})
+		return
+	}
+
+	released, err := models.DeleteVideo(video.ID)
+	if err != nil {
+		log.Printf("Error deleting video %s: %v", video.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete video"})
+		return
+	}
+	if released != "" {
+		if err := storage.DeleteAll(c.Request.Context(), Storage, released+"/"); err != nil {
+			log.Printf("Failed to remove video files %s: %v", released, err)
+		}
+	}
+	// 封面属于视频本身，不在被删除的媒体目录中时单独删除
+	if released != video.ID {
+		if err := storage.DeleteAll(c.Request.Context(), Storage, video.ID+"/poster/"); err != nil {
+			log.Printf("Failed to remove poster of %s: %v", video.ID, err)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "Video deleted",
+		"filesRemoved": released != "",
+	})
+}
@@ -1,18 +1,26 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
-	"path/filepath"
+	"strconv"
 	"time"
 
+	"video-streaming/events"
 	"video-streaming/handlers"
 	"video-streaming/models"
+	"video-streaming/services"
+	"video-streaming/storage"
 
 	"github.com/gin-gonic/gin"
 )
 
-const UploadDir = "./videos/temp"
+const (
+	UploadDir = "./videos/temp"
+	// WorkDir 存放转码和打包过程中的中间文件
+	WorkDir = "./videos/work"
+)
 
 func main() {
 	// 设置日志
@@ -23,6 +31,7 @@ func main() {
 	dirs := []string{
 		"./videos",
 		"./videos/temp",
+		"./videos/work",
 		"./frontend",
 	}
 	for _, dir := range dirs {
@@ -38,12 +47,53 @@ func main() {
 	}
 	log.Println("Database initialized successfully")
 
+	// 原始文件和转码结果保存在存储后端，默认为本地 ./videos 目录
+	store, err := newStorage()
+	if err != nil {
+		log.Fatalf("Failed to initialize storage: %v", err)
+	}
+
+	// 转码工作协程数即同时运行的 ffmpeg 数量
+	transcodeService := services.NewTranscodeService(WorkDir, store)
+	if format := os.Getenv("PACKAGING_FORMAT"); format != "" {
+		packaging, err := services.ParsePackagingFormat(format)
+		if err != nil {
+			log.Fatalf("Invalid PACKAGING_FORMAT: %v", err)
+		}
+		transcodeService.Packaging = packaging
+	}
+	// 画质分数需要逐帧比较源视频，默认关闭
+	transcodeService.QualityMetrics = os.Getenv("QUALITY_METRICS") == "true"
+	transcodeService.Thresholds = services.QualityThresholds{
+		VMAF: getEnvFloat("QUALITY_MIN_VMAF", services.DefaultQualityThresholds.VMAF),
+		SSIM: getEnvFloat("QUALITY_MIN_SSIM", services.DefaultQualityThresholds.SSIM),
+		PSNR: getEnvFloat("QUALITY_MIN_PSNR", services.DefaultQualityThresholds.PSNR),
+	}
+	transcodeService.Progress.OnUpdate = func(p *services.VideoProgress) {
+		events.Publish(events.TranscodeProgress, p.VideoID, p)
+	}
+	pipeline := services.NewPipeline(transcodeService, services.NewPlaylistService(WorkDir), services.NewThumbnailService(WorkDir), store)
+	queue := services.NewJobQueue()
+	uploadService := services.NewUploadService(UploadDir, store, queue)
+	queue.Register(models.JobTypeAssemble, getEnvInt("ASSEMBLY_WORKERS", 2), uploadService.AssembleJob)
+	queue.Register(models.JobTypeTranscode, getEnvInt("TRANSCODE_WORKERS", 2), pipeline.ProcessJob)
+	if err := queue.Start(); err != nil {
+		log.Fatalf("Failed to start job queue: %v", err)
+	}
+	handlers.Uploads = uploadService
+	handlers.Storage = store
+	handlers.Progress = transcodeService.Progress
+	handlers.Posters = services.NewPosterService(WorkDir, store)
+	handlers.AdminToken = os.Getenv("ADMIN_TOKEN")
+	if handlers.AdminToken == "" {
+		log.Println("ADMIN_TOKEN is not set, admin endpoints are disabled")
+	}
+
 	// 设置 Gin 模式
 	gin.SetMode(gin.DebugMode)
 	r := gin.Default()
 
 	// 静态文件服务
-	r.Static("/videos", "./videos")
 	r.Static("/static", "./frontend")
 
 	// 路由设置
@@ -58,16 +108,56 @@ func main() {
 		api.POST("/upload/init", handlers.InitUpload)
 		api.POST("/upload/chunk", handlers.UploadChunk)
 		api.POST("/upload/complete", handlers.CompleteUpload)
+		api.GET("/upload/:uploadId/status", handlers.GetUploadStatus)
+		api.DELETE("/upload/:uploadId", handlers.AbortUpload)
+
+		// tus 1.0 断点续传协议
+		api.OPTIONS("/tus", handlers.TusOptions)
+		api.POST("/tus", handlers.TusCreate)
+		api.OPTIONS("/tus/:id", handlers.TusOptions)
+		api.HEAD("/tus/:id", handlers.TusHead)
+		api.PATCH("/tus/:id", handlers.TusPatch)
+		api.DELETE("/tus/:id", handlers.TusDelete)
 
 		// 视频列表和播放相关
 		api.GET("/videos", handlers.GetVideoList)
 		api.GET("/videos/:id", handlers.GetVideoInfo)
+		api.DELETE("/videos/:id", handlers.DeleteVideo)
 		api.GET("/videos/:id/info", handlers.GetVideoInfo)
 		api.GET("/videos/:id/stream", handlers.StreamVideo)
+		api.GET("/videos/:id/hls/*file", handlers.ServeHLS)
+		api.GET("/videos/:id/dash/*file", handlers.ServeDASH)
+		api.GET("/videos/:id/thumbnails", handlers.GetThumbnails)
+		api.GET("/videos/:id/thumbnails/*file", handlers.ServeThumbnail)
+		api.POST("/videos/:id/poster", handlers.UploadPoster)
+		api.POST("/videos/:id/poster/frame", handlers.SetPosterFrame)
+		api.GET("/videos/:id/poster/:size", handlers.ServePoster)
+		api.GET("/videos/:id/ladder", handlers.GetLadder)
+		api.GET("/videos/:id/quality", handlers.GetQualityScores)
+		api.GET("/videos/:id/progress", handlers.GetVideoProgress)
+		api.GET("/videos/:id/jobs", handlers.GetVideoJobs)
+
+		// 视频生命周期事件 (SSE)
+		api.GET("/events", handlers.StreamEvents)
+
+		// 后台任务
+		api.GET("/jobs/:id", handlers.GetJob)
+		api.POST("/jobs/:id/cancel", handlers.CancelJob)
+
+		// 管理接口
+		admin := api.Group("/admin", handlers.RequireAdmin)
+		{
+			// 编码配置
+			admin.GET("/profiles", handlers.ListProfiles)
+			admin.POST("/profiles", handlers.CreateProfile)
+			admin.GET("/profiles/:id", handlers.GetProfile)
+			admin.PUT("/profiles/:id", handlers.UpdateProfile)
+			admin.DELETE("/profiles/:id", handlers.DeleteProfile)
+		}
 	}
 
 	// 启动清理任务
-	cleanupTempFiles()
+	cleanupTempFiles(uploadService)
 
 	// 启动服务器
 	port := ":8080"
@@ -77,63 +167,68 @@ func main() {
 	}
 }
 
-func fileExists(path string) bool {
-	_, err := os.Stat(path)
-	return err == nil
+// newStorage 根据 STORAGE_DRIVER 创建存储后端，可选 local（默认）和 s3
+func newStorage() (storage.Storage, error) {
+	switch driver := os.Getenv("STORAGE_DRIVER"); driver {
+	case "", "local":
+		return storage.NewLocal(getEnv("STORAGE_DIR", "./videos"))
+	case "s3":
+		return storage.NewS3(storage.S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			UseSSL:    os.Getenv("S3_USE_SSL") != "false",
+			Prefix:    os.Getenv("S3_PREFIX"),
+		})
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_DRIVER %q", driver)
+	}
 }
 
-func CleanInvalidVideos() error {
-	rows, err := models.DB.Query(`SELECT id FROM videos`)
-	if err != nil {
-		return err
+// 读取字符串环境变量，未设置时返回默认值
+func getEnv(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
 	}
-	defer rows.Close()
+	return def
+}
 
-	for rows.Next() {
-		var id string
-		if err := rows.Scan(&id); err != nil {
-			continue
-		}
-		videoDir := "./videos/" + id
-		exists := false
-		for _, res := range []string{"1080p.mp4", "720p.mp4", "480p.mp4"} {
-			if fileExists(videoDir + "/" + res) {
-				exists = true
-				break
-			}
+// 读取整数环境变量，未设置或无效时返回默认值
+func getEnvInt(key string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return v
+	}
+	return def
+}
+
+// 读取浮点数环境变量，未设置或无效时返回默认值
+func getEnvFloat(key string, def float64) float64 {
+	if v, err := strconv.ParseFloat(os.Getenv(key), 64); err == nil {
+		return v
+	}
+	return def
+}
+
+// cleanupTempFiles 每小时清理一次过期的上传会话
+func cleanupTempFiles(uploads *services.UploadService) {
+	sweep := func() {
+		n, err := uploads.SweepExpired()
+		if err != nil {
+			log.Printf("Failed to sweep expired uploads: %v", err)
+			return
 		}
-		if !exists {
-			models.DB.Exec(`DELETE FROM videos WHERE id = ?`, id)
+		if n > 0 {
+			log.Printf("Expired %d upload sessions", n)
 		}
 	}
-	return nil
-}
 
-func cleanupTempFiles() {
+	sweep()
 	ticker := time.NewTicker(1 * time.Hour)
 	go func() {
 		for range ticker.C {
-			files, err := os.ReadDir(UploadDir)
-			if err != nil {
-				log.Printf("Failed to read temp directory: %v", err)
-				continue
-			}
-
-			for _, file := range files {
-				if file.IsDir() {
-					// 检查目录是否超过24小时
-					info, err := file.Info()
-					if err != nil {
-						continue
-					}
-					if time.Since(info.ModTime()) > 24*time.Hour {
-						path := filepath.Join(UploadDir, file.Name())
-						if err := os.RemoveAll(path); err != nil {
-							log.Printf("Failed to remove old temp directory %s: %v", path, err)
-						}
-					}
-				}
-			}
+			sweep()
 		}
 	}()
 }
@@ -10,7 +10,8 @@ var DB *sql.DB
 
 func InitDB(dbPath string) error {
 	var err error
-	DB, err = sql.Open("sqlite", dbPath)
+	// 转码工作协程会并发写库，设置 busy_timeout 避免 SQLITE_BUSY
+	DB, err = sql.Open("sqlite", dbPath+"?_pragma=busy_timeout(5000)")
 	if err != nil {
 		return err
 	}
@@ -47,5 +48,263 @@ func InitDB(dbPath string) error {
 		return err
 	}
 
-	return nil
+	// 创建后台任务表
+	_, err = DB.Exec(`
+        CREATE TABLE IF NOT EXISTS jobs (
+            id TEXT PRIMARY KEY,
+            video_id TEXT NOT NULL,
+            type TEXT NOT NULL,
+            status TEXT NOT NULL,
+            attempts INTEGER NOT NULL DEFAULT 0,
+            error TEXT NOT NULL DEFAULT '',
+            created_at DATETIME NOT NULL,
+            updated_at DATETIME NOT NULL,
+            started_at DATETIME,
+            finished_at DATETIME,
+            FOREIGN KEY (video_id) REFERENCES videos(id)
+        )
+    `)
+	if err != nil {
+		return err
+	}
+
+	_, err = DB.Exec(`CREATE INDEX IF NOT EXISTS idx_jobs_status ON jobs(status, type, created_at)`)
+	if err != nil {
+		return err
+	}
+
+	// 创建上传会话表，中止或过期的会话在视频记录删除后仍然保留
+	_, err = DB.Exec(`
+        CREATE TABLE IF NOT EXISTS upload_sessions (
+            id TEXT PRIMARY KEY,
+            video_id TEXT NOT NULL,
+            protocol TEXT NOT NULL,
+            file_name TEXT NOT NULL,
+            file_size INTEGER NOT NULL,
+            chunk_size INTEGER NOT NULL,
+            chunk_count INTEGER NOT NULL,
+            checksum TEXT NOT NULL DEFAULT '',
+            owner TEXT NOT NULL DEFAULT '',
+            state TEXT NOT NULL,
+            created_at DATETIME NOT NULL,
+            updated_at DATETIME NOT NULL,
+            expires_at DATETIME NOT NULL
+        )
+    `)
+	if err != nil {
+		return err
+	}
+
+	_, err = DB.Exec(`CREATE INDEX IF NOT EXISTS idx_upload_sessions_state ON upload_sessions(state, expires_at)`)
+	if err != nil {
+		return err
+	}
+
+	// 创建媒体表，内容相同的视频共用同一份原始文件和转码结果
+	// id 是文件所在目录，即第一个上传该内容的视频 ID
+	_, err = DB.Exec(`
+        CREATE TABLE IF NOT EXISTS media (
+            id TEXT PRIMARY KEY,
+            content_hash TEXT NOT NULL,
+            ref_count INTEGER NOT NULL,
+            created_at DATETIME NOT NULL,
+            updated_at DATETIME NOT NULL
+        )
+    `)
+	if err != nil {
+		return err
+	}
+
+	_, err = DB.Exec(`CREATE INDEX IF NOT EXISTS idx_media_content_hash ON media(content_hash)`)
+	if err != nil {
+		return err
+	}
+
+	// 创建编码配置表，阶梯以 JSON 保存，最多只有一个默认配置
+	_, err = DB.Exec(`
+        CREATE TABLE IF NOT EXISTS encoding_profiles (
+            id TEXT PRIMARY KEY,
+            name TEXT NOT NULL UNIQUE,
+            is_default BOOLEAN NOT NULL DEFAULT 0,
+            renditions TEXT NOT NULL,
+            created_at DATETIME NOT NULL,
+            updated_at DATETIME NOT NULL
+        )
+    `)
+	if err != nil {
+		return err
+	}
+
+	_, err = DB.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_encoding_profiles_default ON encoding_profiles(is_default) WHERE is_default = 1`)
+	if err != nil {
+		return err
+	}
+
+	// 创建媒体元数据表，每个文件一行，rendition 为清晰度名称，源文件为 original
+	// 没有对应的流时编码字段为空字符串
+	_, err = DB.Exec(`
+        CREATE TABLE IF NOT EXISTS media_metadata (
+            media_id TEXT NOT NULL,
+            rendition TEXT NOT NULL,
+            duration REAL NOT NULL DEFAULT 0,
+            container TEXT NOT NULL DEFAULT '',
+            size INTEGER NOT NULL DEFAULT 0,
+            bitrate INTEGER NOT NULL DEFAULT 0,
+            video_codec TEXT NOT NULL DEFAULT '',
+            video_profile TEXT NOT NULL DEFAULT '',
+            width INTEGER NOT NULL DEFAULT 0,
+            height INTEGER NOT NULL DEFAULT 0,
+            fps REAL NOT NULL DEFAULT 0,
+            rotation INTEGER NOT NULL DEFAULT 0,
+            video_bitrate INTEGER NOT NULL DEFAULT 0,
+            pix_fmt TEXT NOT NULL DEFAULT '',
+            color_space TEXT NOT NULL DEFAULT '',
+            color_transfer TEXT NOT NULL DEFAULT '',
+            color_primaries TEXT NOT NULL DEFAULT '',
+            color_range TEXT NOT NULL DEFAULT '',
+            audio_codec TEXT NOT NULL DEFAULT '',
+            sample_rate INTEGER NOT NULL DEFAULT 0,
+            channels INTEGER NOT NULL DEFAULT 0,
+            channel_layout TEXT NOT NULL DEFAULT '',
+            audio_bitrate INTEGER NOT NULL DEFAULT 0,
+            probed_at DATETIME NOT NULL,
+            PRIMARY KEY (media_id, rendition)
+        )
+    `)
+	if err != nil {
+		return err
+	}
+
+	// 按编码筛选源文件
+	_, err = DB.Exec(`CREATE INDEX IF NOT EXISTS idx_media_metadata_codec ON media_metadata(video_codec, audio_codec)`)
+	if err != nil {
+		return err
+	}
+
+	// 创建按内容调整阶梯的分析结果表，trials 以 JSON 保存试编码结果
+	_, err = DB.Exec(`
+        CREATE TABLE IF NOT EXISTS ladder_analyses (
+            media_id TEXT PRIMARY KEY,
+            trial_width INTEGER NOT NULL,
+            trial_height INTEGER NOT NULL,
+            complexity REAL NOT NULL,
+            trials TEXT NOT NULL,
+            analyzed_at DATETIME NOT NULL
+        )
+    `)
+	if err != nil {
+		return err
+	}
+
+	// 每个清晰度配置的码率和选择的码率，单位 bit/s
+	_, err = DB.Exec(`
+        CREATE TABLE IF NOT EXISTS ladder_rungs (
+            media_id TEXT NOT NULL,
+            rendition TEXT NOT NULL,
+            width INTEGER NOT NULL,
+            height INTEGER NOT NULL,
+            rate_control TEXT NOT NULL,
+            predicted_bitrate INTEGER NOT NULL,
+            configured_bitrate INTEGER NOT NULL,
+            chosen_bitrate INTEGER NOT NULL,
+            PRIMARY KEY (media_id, rendition)
+        )
+    `)
+	if err != nil {
+		return err
+	}
+
+	// 旧数据库的视频表没有内容哈希和媒体字段
+	if err := addColumn("videos", "content_hash", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumn("videos", "media_id", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+
+	// 直传分段上传之前的会话都经由本服务上传
+	if err := addColumn("upload_sessions", "mode", "TEXT NOT NULL DEFAULT 'proxy'"); err != nil {
+		return err
+	}
+	if err := addColumn("upload_sessions", "multipart_id", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+
+	// 编码配置之前的视频和媒体使用当时固定的阶梯，即默认配置
+	if err := addColumn("videos", "profile_id", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumn("media", "profile_id", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+
+	// 旧的清晰度记录没有实际输出尺寸
+	if err := addColumn("video_qualities", "width", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumn("video_qualities", "height", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+
+	// 客观画质分数，未计算或 ffmpeg 不支持该指标时为 NULL
+	for _, column := range []string{"vmaf", "ssim", "psnr"} {
+		if err := addColumn("video_qualities", column, "REAL"); err != nil {
+			return err
+		}
+	}
+	if err := addColumn("video_qualities", "below_threshold", "BOOLEAN NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumn("video_qualities", "scored_at", "DATETIME"); err != nil {
+		return err
+	}
+
+	// 之前的编码配置每个清晰度单独解码
+	if err := addColumn("encoding_profiles", "single_decode", "BOOLEAN NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+
+	// 之前的编码配置都使用固定阶梯
+	if err := addColumn("encoding_profiles", "per_title", "BOOLEAN NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+
+	// 封面功能之前的视频都使用自动生成的缩略图
+	if err := addColumn("videos", "poster_source", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumn("videos", "poster_timestamp", "REAL NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumn("videos", "poster_updated_at", "DATETIME"); err != nil {
+		return err
+	}
+
+	return seedDefaultProfile()
+}
+
+// addColumn 在列不存在时为表添加列
+func addColumn(table, column, definition string) error {
+	rows, err := DB.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = DB.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + definition)
+	return err
 }
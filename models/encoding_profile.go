@@ -0,0 +1,227 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrDefaultProfile 表示不能删除默认编码配置
+var ErrDefaultProfile = errors.New("cannot delete the default profile")
+
+// EncodingProfile 是一套命名的转码阶梯，上传时可以选择，未选择时使用默认配置
+type EncodingProfile struct {
+	ID           string      `json:"id"`
+	Name         string      `json:"name"`
+	IsDefault    bool        `json:"isDefault"`
+	SingleDecode bool        `json:"singleDecode"` // 只解码一次，在同一个 ffmpeg 中编码所有清晰度
+	PerTitle     bool        `json:"perTitle"`     // 转码前试编码分析画面复杂度，为每个视频调整各清晰度的码率
+	Renditions   []Rendition `json:"renditions"`
+	CreatedAt    time.Time   `json:"createdAt"`
+	UpdatedAt    time.Time   `json:"updatedAt"`
+}
+
+// Rendition 是阶梯中的一个清晰度，Name 同时用作输出文件名和 quality 参数
+type Rendition struct {
+	Name         string `json:"name"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	VideoCodec   string `json:"videoCodec"` // libx264, libx265
+	Preset       string `json:"preset"`
+	RateControl  string `json:"rateControl"`       // crf, 2pass, cq
+	CRF          int    `json:"crf,omitempty"`     // crf 和 cq 模式的质量
+	Bitrate      string `json:"bitrate,omitempty"` // 2pass 模式的目标码率，例如 "2500k"
+	MaxRate      string `json:"maxrate,omitempty"`
+	BufSize      string `json:"bufsize,omitempty"`
+	AudioBitrate string `json:"audioBitrate"`
+	Container    string `json:"container"` // mp4（faststart）, fmp4（分片 MP4）
+}
+
+// 码率控制模式
+const (
+	// RateControlCRF 按 CRF 编码，用 maxrate 和 bufsize 限制峰值码率
+	RateControlCRF = "crf"
+	// RateControlTwoPass 第一遍分析画面复杂度，第二遍按目标码率分配，文件大小可预测
+	RateControlTwoPass = "2pass"
+	// RateControlCQ 只按 CRF 编码，不限制码率
+	RateControlCQ = "cq"
+)
+
+// Resolution 返回 "宽x高" 形式的分辨率
+func (r Rendition) Resolution() string {
+	return fmt.Sprintf("%dx%d", r.Width, r.Height)
+}
+
+// defaultProfile 是没有任何配置时创建的默认阶梯
+var defaultProfile = EncodingProfile{
+	Name:      "standard",
+	IsDefault: true,
+	Renditions: []Rendition{
+		{Name: "1080p", Width: 1920, Height: 1080, VideoCodec: "libx264", Preset: "medium", RateControl: RateControlCRF, CRF: 23, MaxRate: "4000k", BufSize: "8000k", AudioBitrate: "128k", Container: "mp4"},
+		{Name: "720p", Width: 1280, Height: 720, VideoCodec: "libx264", Preset: "medium", RateControl: RateControlCRF, CRF: 23, MaxRate: "2500k", BufSize: "5000k", AudioBitrate: "128k", Container: "mp4"},
+		{Name: "480p", Width: 854, Height: 480, VideoCodec: "libx264", Preset: "medium", RateControl: RateControlCRF, CRF: 23, MaxRate: "1000k", BufSize: "2000k", AudioBitrate: "128k", Container: "mp4"},
+	},
+}
+
+const profileColumns = `id, name, is_default, single_decode, per_title, renditions, created_at, updated_at`
+
+func scanProfile(row rowScanner) (*EncodingProfile, error) {
+	var p EncodingProfile
+	var renditions string
+	if err := row.Scan(&p.ID, &p.Name, &p.IsDefault, &p.SingleDecode, &p.PerTitle, &renditions, &p.CreatedAt, &p.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(renditions), &p.Renditions); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// seedDefaultProfile 在表为空时创建默认配置
+func seedDefaultProfile() error {
+	var n int
+	if err := DB.QueryRow(`SELECT COUNT(*) FROM encoding_profiles`).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	p := defaultProfile
+	return CreateProfile(&p)
+}
+
+// CreateProfile 保存新的编码配置，IsDefault 为 true 时取代原来的默认配置
+func CreateProfile(p *EncodingProfile) error {
+	renditions, err := json.Marshal(p.Renditions)
+	if err != nil {
+		return err
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if p.IsDefault {
+		if _, err := tx.Exec(`UPDATE encoding_profiles SET is_default = 0 WHERE is_default = 1`); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	p.ID = uuid.New().String()
+	p.CreatedAt = now
+	p.UpdatedAt = now
+	_, err = tx.Exec(`
+		INSERT INTO encoding_profiles (`+profileColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, p.ID, p.Name, p.IsDefault, p.SingleDecode, p.PerTitle, string(renditions), p.CreatedAt, p.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UpdateProfile 替换编码配置的名称、转码方式和阶梯
+// 不能通过取消 IsDefault 让系统没有默认配置，只能把另一个配置设为默认
+func UpdateProfile(p *EncodingProfile) error {
+	renditions, err := json.Marshal(p.Renditions)
+	if err != nil {
+		return err
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var wasDefault bool
+	if err := tx.QueryRow(`SELECT is_default FROM encoding_profiles WHERE id = ?`, p.ID).Scan(&wasDefault); err != nil {
+		return err
+	}
+	if wasDefault {
+		p.IsDefault = true
+	} else if p.IsDefault {
+		if _, err := tx.Exec(`UPDATE encoding_profiles SET is_default = 0 WHERE is_default = 1`); err != nil {
+			return err
+		}
+	}
+
+	p.UpdatedAt = time.Now()
+	_, err = tx.Exec(`
+		UPDATE encoding_profiles SET name = ?, is_default = ?, single_decode = ?, per_title = ?, renditions = ?, updated_at = ?
+		WHERE id = ?
+	`, p.Name, p.IsDefault, p.SingleDecode, p.PerTitle, string(renditions), p.UpdatedAt, p.ID)
+	if err != nil {
+		return err
+	}
+	if err := tx.QueryRow(`SELECT created_at FROM encoding_profiles WHERE id = ?`, p.ID).Scan(&p.CreatedAt); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteProfile 删除编码配置，默认配置不能删除
+// 引用该配置但尚未转码的视频会改用默认配置
+func DeleteProfile(id string) error {
+	var isDefault bool
+	if err := DB.QueryRow(`SELECT is_default FROM encoding_profiles WHERE id = ?`, id).Scan(&isDefault); err != nil {
+		return err
+	}
+	if isDefault {
+		return ErrDefaultProfile
+	}
+	_, err := DB.Exec(`DELETE FROM encoding_profiles WHERE id = ? AND is_default = 0`, id)
+	return err
+}
+
+func GetProfile(id string) (*EncodingProfile, error) {
+	return scanProfile(DB.QueryRow(`SELECT `+profileColumns+` FROM encoding_profiles WHERE id = ?`, id))
+}
+
+func GetProfileByName(name string) (*EncodingProfile, error) {
+	return scanProfile(DB.QueryRow(`SELECT `+profileColumns+` FROM encoding_profiles WHERE name = ?`, name))
+}
+
+func GetDefaultProfile() (*EncodingProfile, error) {
+	return scanProfile(DB.QueryRow(`SELECT ` + profileColumns + ` FROM encoding_profiles WHERE is_default = 1`))
+}
+
+// GetVideoProfile 返回视频上传时选择的编码配置，配置已被删除时返回默认配置
+func GetVideoProfile(videoID string) (*EncodingProfile, error) {
+	var profileID string
+	if err := DB.QueryRow(`SELECT profile_id FROM videos WHERE id = ?`, videoID).Scan(&profileID); err != nil {
+		return nil, err
+	}
+	if profileID != "" {
+		p, err := GetProfile(profileID)
+		if !errors.Is(err, sql.ErrNoRows) {
+			return p, err
+		}
+	}
+	return GetDefaultProfile()
+}
+
+func GetProfiles() ([]*EncodingProfile, error) {
+	rows, err := DB.Query(`SELECT ` + profileColumns + ` FROM encoding_profiles ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var profiles []*EncodingProfile
+	for rows.Next() {
+		p, err := scanProfile(rows)
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, p)
+	}
+	return profiles, rows.Err()
+}
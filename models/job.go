@@ -0,0 +1,178 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// 任务类型
+const (
+	JobTypeAssemble  = "assemble"
+	JobTypeTranscode = "transcode"
+)
+
+// 任务状态
+const (
+	JobStatusQueued    = "queued"
+	JobStatusRunning   = "running"
+	JobStatusSucceeded = "succeeded"
+	JobStatusFailed    = "failed"
+	JobStatusCancelled = "cancelled"
+)
+
+type Job struct {
+	ID         string     `json:"id"`
+	VideoID    string     `json:"videoId"`
+	Type       string     `json:"type"`
+	Status     string     `json:"status"` // queued, running, succeeded, failed, cancelled
+	Attempts   int        `json:"attempts"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	UpdatedAt  time.Time  `json:"updatedAt"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+const jobColumns = `id, video_id, type, status, attempts, error, created_at, updated_at, started_at, finished_at`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanJob(row rowScanner) (*Job, error) {
+	var j Job
+	var startedAt, finishedAt sql.NullTime
+	err := row.Scan(&j.ID, &j.VideoID, &j.Type, &j.Status, &j.Attempts, &j.Error,
+		&j.CreatedAt, &j.UpdatedAt, &startedAt, &finishedAt)
+	if err != nil {
+		return nil, err
+	}
+	if startedAt.Valid {
+		j.StartedAt = &startedAt.Time
+	}
+	if finishedAt.Valid {
+		j.FinishedAt = &finishedAt.Time
+	}
+	return &j, nil
+}
+
+// 创建排队中的任务
+func CreateJob(videoID, jobType string) (*Job, error) {
+	now := time.Now()
+	job := &Job{
+		ID:        uuid.New().String(),
+		VideoID:   videoID,
+		Type:      jobType,
+		Status:    JobStatusQueued,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	_, err := DB.Exec(`
+		INSERT INTO jobs (id, video_id, type, status, attempts, error, created_at, updated_at)
+		VALUES (?, ?, ?, ?, 0, '', ?, ?)
+	`, job.ID, job.VideoID, job.Type, job.Status, job.CreatedAt, job.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func GetJobByID(id string) (*Job, error) {
+	return scanJob(DB.QueryRow(`SELECT `+jobColumns+` FROM jobs WHERE id = ?`, id))
+}
+
+// 获取视频的所有任务，按创建时间排序
+func GetJobsByVideoID(videoID string) ([]*Job, error) {
+	rows, err := DB.Query(`SELECT `+jobColumns+` FROM jobs WHERE video_id = ? ORDER BY created_at`, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []*Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// 原子地领取指定类型最早的排队任务，没有任务时返回 sql.ErrNoRows
+func ClaimNextJob(jobType string) (*Job, error) {
+	now := time.Now()
+	return scanJob(DB.QueryRow(`
+		UPDATE jobs
+		SET status = ?, attempts = attempts + 1, started_at = ?, updated_at = ?
+		WHERE id = (
+			SELECT id FROM jobs WHERE status = ? AND type = ? ORDER BY created_at LIMIT 1
+		) AND status = ?
+		RETURNING `+jobColumns,
+		JobStatusRunning, now, now, JobStatusQueued, jobType, JobStatusQueued))
+}
+
+// 结束任务，errMsg 为空表示成功
+func FinishJob(id, status, errMsg string) error {
+	now := time.Now()
+	_, err := DB.Exec(`
+		UPDATE jobs SET status = ?, error = ?, finished_at = ?, updated_at = ?
+		WHERE id = ?
+	`, status, errMsg, now, now, id)
+	return err
+}
+
+// 取消排队中的任务，返回是否取消成功
+func CancelJob(id string) (bool, error) {
+	now := time.Now()
+	res, err := DB.Exec(`
+		UPDATE jobs SET status = ?, finished_at = ?, updated_at = ?
+		WHERE id = ? AND status = ?
+	`, JobStatusCancelled, now, now, id, JobStatusQueued)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// 服务重启后把上次未完成的任务重新放回队列
+func RequeueRunningJobs() (int64, error) {
+	res, err := DB.Exec(`
+		UPDATE jobs SET status = ?, started_at = NULL, updated_at = ?
+		WHERE status = ?
+	`, JobStatusQueued, time.Now(), JobStatusRunning)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// 查找处于 processing 状态但没有活动任务的视频
+// 复用其他视频媒体的视频没有自己的任务，由媒体所属视频的任务更新状态，不在结果中
+func GetOrphanedProcessingVideos() ([]string, error) {
+	rows, err := DB.Query(`
+		SELECT id FROM videos
+		WHERE status = 'processing' AND (media_id = '' OR media_id = id) AND NOT EXISTS (
+			SELECT 1 FROM jobs
+			WHERE jobs.video_id = videos.id AND jobs.status IN (?, ?)
+		)
+	`, JobStatusQueued, JobStatusRunning)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -0,0 +1,118 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// LadderAnalysis 是按内容调整阶梯的分析结果，每个媒体最多一条，重新转码时覆盖
+type LadderAnalysis struct {
+	MediaID     string        `json:"mediaId"`
+	TrialWidth  int           `json:"trialWidth"`
+	TrialHeight int           `json:"trialHeight"`
+	Complexity  float64       `json:"complexity"` // 参考 CRF 下每像素每帧的比特数，越大画面越复杂
+	Trials      []TrialEncode `json:"trials"`
+	Rungs       []LadderRung  `json:"rungs"`
+	AnalyzedAt  time.Time     `json:"analyzedAt"`
+}
+
+// TrialEncode 是一次试编码的结果
+type TrialEncode struct {
+	CRF     int   `json:"crf"`
+	Bitrate int64 `json:"bitrate"` // 视频码率 bit/s
+}
+
+// LadderRung 记录一个清晰度配置的码率和为该视频选择的码率，单位 bit/s
+// crf 模式调整的是 maxrate，2pass 模式调整的是 bitrate，cq 模式不调整，Chosen 为 0
+type LadderRung struct {
+	Rendition   string `json:"rendition"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	RateControl string `json:"rateControl"`
+	Predicted   int64  `json:"predicted"` // 按试编码结果估计的平均码率
+	Configured  int64  `json:"configured"`
+	Chosen      int64  `json:"chosen"`
+}
+
+// SaveLadderAnalysis 保存媒体的分析结果，替换之前的记录
+func SaveLadderAnalysis(a *LadderAnalysis) error {
+	trials, err := json.Marshal(a.Trials)
+	if err != nil {
+		return err
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT OR REPLACE INTO ladder_analyses (media_id, trial_width, trial_height, complexity, trials, analyzed_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, a.MediaID, a.TrialWidth, a.TrialHeight, a.Complexity, string(trials), a.AnalyzedAt)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM ladder_rungs WHERE media_id = ?`, a.MediaID); err != nil {
+		return err
+	}
+	for _, r := range a.Rungs {
+		_, err = tx.Exec(`
+			INSERT INTO ladder_rungs (media_id, rendition, width, height, rate_control, predicted_bitrate, configured_bitrate, chosen_bitrate)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		`, a.MediaID, r.Rendition, r.Width, r.Height, r.RateControl, r.Predicted, r.Configured, r.Chosen)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DeleteLadderAnalysis 删除媒体的分析结果，按固定阶梯重新转码时调用
+func DeleteLadderAnalysis(mediaID string) error {
+	for _, query := range []string{
+		`DELETE FROM ladder_rungs WHERE media_id = ?`,
+		`DELETE FROM ladder_analyses WHERE media_id = ?`,
+	} {
+		if _, err := DB.Exec(query, mediaID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetLadderAnalysis 返回媒体的分析结果，没有分析过时返回 sql.ErrNoRows
+func GetLadderAnalysis(mediaID string) (*LadderAnalysis, error) {
+	a := LadderAnalysis{MediaID: mediaID}
+	var trials string
+	err := DB.QueryRow(`
+		SELECT trial_width, trial_height, complexity, trials, analyzed_at
+		FROM ladder_analyses WHERE media_id = ?
+	`, mediaID).Scan(&a.TrialWidth, &a.TrialHeight, &a.Complexity, &trials, &a.AnalyzedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(trials), &a.Trials); err != nil {
+		return nil, err
+	}
+
+	rows, err := DB.Query(`
+		SELECT rendition, width, height, rate_control, predicted_bitrate, configured_bitrate, chosen_bitrate
+		FROM ladder_rungs WHERE media_id = ? ORDER BY width * height DESC
+	`, mediaID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	a.Rungs = []LadderRung{}
+	for rows.Next() {
+		var r LadderRung
+		if err := rows.Scan(&r.Rendition, &r.Width, &r.Height, &r.RateControl, &r.Predicted, &r.Configured, &r.Chosen); err != nil {
+			return nil, err
+		}
+		a.Rungs = append(a.Rungs, r)
+	}
+	return &a, rows.Err()
+}
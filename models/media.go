@@ -0,0 +1,82 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// AttachMedia 记录视频的内容哈希，并让视频引用内容和编码配置都相同的已有媒体
+// 没有可复用的媒体时以视频自身为媒体，reused 表示是否复用了其他视频的文件
+func AttachMedia(videoID, contentHash string) (mediaID string, reused bool, err error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return "", false, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	// 先写入，提前拿到写锁，避免并发上传相同内容时重复创建媒体
+	_, err = tx.Exec(`UPDATE videos SET content_hash = ?, updated_at = ? WHERE id = ?`, contentHash, now, videoID)
+	if err != nil {
+		return "", false, err
+	}
+
+	// 重复执行时保持原有的引用
+	var profileID string
+	if err := tx.QueryRow(`SELECT media_id, profile_id FROM videos WHERE id = ?`, videoID).Scan(&mediaID, &profileID); err != nil {
+		return "", false, err
+	}
+	if mediaID != "" {
+		return mediaID, mediaID != videoID, tx.Commit()
+	}
+
+	// 只复用转码成功或正在转码的媒体，失败的内容重新处理
+	err = tx.QueryRow(`
+		SELECT m.id FROM media m
+		WHERE m.content_hash = ? AND m.profile_id = ? AND m.ref_count > 0 AND EXISTS (
+			SELECT 1 FROM videos v
+			WHERE v.media_id = m.id AND v.status IN ('ready', 'processing')
+		)
+		ORDER BY m.created_at
+		LIMIT 1
+	`, contentHash, profileID).Scan(&mediaID)
+	switch {
+	case err == nil:
+		reused = true
+		_, err = tx.Exec(`UPDATE media SET ref_count = ref_count + 1, updated_at = ? WHERE id = ?`, now, mediaID)
+	case errors.Is(err, sql.ErrNoRows):
+		mediaID = videoID
+		_, err = tx.Exec(`
+			INSERT INTO media (id, content_hash, profile_id, ref_count, created_at, updated_at)
+			VALUES (?, ?, ?, 1, ?, ?)
+		`, mediaID, contentHash, profileID, now, now)
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	if _, err := tx.Exec(`UPDATE videos SET media_id = ? WHERE id = ?`, mediaID, videoID); err != nil {
+		return "", false, err
+	}
+	return mediaID, reused, tx.Commit()
+}
+
+// GetMediaStatus 返回媒体的处理状态，有任一视频可以播放时为 ready
+func GetMediaStatus(mediaID string) (string, error) {
+	var ready, processing int
+	err := DB.QueryRow(`
+		SELECT COUNT(CASE status WHEN 'ready' THEN 1 END), COUNT(CASE status WHEN 'processing' THEN 1 END)
+		FROM videos WHERE media_id = ?
+	`, mediaID).Scan(&ready, &processing)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case ready > 0:
+		return "ready", nil
+	case processing > 0:
+		return "processing", nil
+	}
+	return "error", nil
+}
@@ -0,0 +1,140 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// 源文件和悬停预览在元数据表中使用的 rendition 名称，编码配置不能使用
+const (
+	MetadataOriginal = "original"
+	MetadataPreview  = "preview"
+)
+
+// MediaMetadata 是 ffprobe 解析出的文件技术参数，没有对应的流时 Video 或 Audio 为 nil
+type MediaMetadata struct {
+	Duration  float64          `json:"duration"`  // 秒
+	Container string           `json:"container"` // ffprobe 的 format_name，例如 "mov,mp4,m4a,3gp,3g2,mj2"
+	Size      int64            `json:"size"`
+	Bitrate   int64            `json:"bitrate"` // 整个文件的码率 bit/s
+	Video     *VideoStreamInfo `json:"video,omitempty"`
+	Audio     *AudioStreamInfo `json:"audio,omitempty"`
+	ProbedAt  time.Time        `json:"probedAt"`
+}
+
+type VideoStreamInfo struct {
+	Codec          string  `json:"codec"`
+	Profile        string  `json:"profile,omitempty"`
+	Width          int     `json:"width"`
+	Height         int     `json:"height"`
+	FPS            float64 `json:"fps"`
+	Rotation       int     `json:"rotation,omitempty"` // 顺时针旋转角度
+	Bitrate        int64   `json:"bitrate,omitempty"`
+	PixelFormat    string  `json:"pixelFormat,omitempty"`
+	ColorSpace     string  `json:"colorSpace,omitempty"`
+	ColorTransfer  string  `json:"colorTransfer,omitempty"`
+	ColorPrimaries string  `json:"colorPrimaries,omitempty"`
+	ColorRange     string  `json:"colorRange,omitempty"`
+}
+
+type AudioStreamInfo struct {
+	Codec         string `json:"codec"`
+	SampleRate    int    `json:"sampleRate"`
+	Channels      int    `json:"channels"`
+	ChannelLayout string `json:"channelLayout,omitempty"`
+	Bitrate       int64  `json:"bitrate,omitempty"`
+}
+
+const metadataColumns = `duration, container, size, bitrate,
+	video_codec, video_profile, width, height, fps, rotation, video_bitrate, pix_fmt,
+	color_space, color_transfer, color_primaries, color_range,
+	audio_codec, sample_rate, channels, channel_layout, audio_bitrate, probed_at`
+
+func scanMetadata(row rowScanner, rendition *string) (*MediaMetadata, error) {
+	var m MediaMetadata
+	var v VideoStreamInfo
+	var a AudioStreamInfo
+	err := row.Scan(rendition, &m.Duration, &m.Container, &m.Size, &m.Bitrate,
+		&v.Codec, &v.Profile, &v.Width, &v.Height, &v.FPS, &v.Rotation, &v.Bitrate, &v.PixelFormat,
+		&v.ColorSpace, &v.ColorTransfer, &v.ColorPrimaries, &v.ColorRange,
+		&a.Codec, &a.SampleRate, &a.Channels, &a.ChannelLayout, &a.Bitrate, &m.ProbedAt)
+	if err != nil {
+		return nil, err
+	}
+	// 编码为空表示文件没有这种流
+	if v.Codec != "" {
+		m.Video = &v
+	}
+	if a.Codec != "" {
+		m.Audio = &a
+	}
+	return &m, nil
+}
+
+// SaveMetadata 保存媒体的一个文件的元数据，rendition 为清晰度名称或 MetadataOriginal
+func SaveMetadata(mediaID, rendition string, m *MediaMetadata) error {
+	var v VideoStreamInfo
+	var a AudioStreamInfo
+	if m.Video != nil {
+		v = *m.Video
+	}
+	if m.Audio != nil {
+		a = *m.Audio
+	}
+	_, err := DB.Exec(`
+		INSERT OR REPLACE INTO media_metadata (media_id, rendition, `+metadataColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, mediaID, rendition, m.Duration, m.Container, m.Size, m.Bitrate,
+		v.Codec, v.Profile, v.Width, v.Height, v.FPS, v.Rotation, v.Bitrate, v.PixelFormat,
+		v.ColorSpace, v.ColorTransfer, v.ColorPrimaries, v.ColorRange,
+		a.Codec, a.SampleRate, a.Channels, a.ChannelLayout, a.Bitrate, m.ProbedAt)
+	return err
+}
+
+// DeleteRenditionMetadata 删除媒体各清晰度和预览的元数据，重新转码前调用，保留源文件的元数据
+func DeleteRenditionMetadata(mediaID string) error {
+	_, err := DB.Exec(`DELETE FROM media_metadata WHERE media_id = ? AND rendition != ?`, mediaID, MetadataOriginal)
+	return err
+}
+
+// GetMetadata 返回媒体所有文件的元数据，键为 rendition
+func GetMetadata(mediaID string) (map[string]*MediaMetadata, error) {
+	rows, err := DB.Query(`
+		SELECT rendition, `+metadataColumns+`
+		FROM media_metadata WHERE media_id = ?
+	`, mediaID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	metadata := make(map[string]*MediaMetadata)
+	for rows.Next() {
+		var rendition string
+		m, err := scanMetadata(rows, &rendition)
+		if err != nil {
+			return nil, err
+		}
+		metadata[rendition] = m
+	}
+	return metadata, rows.Err()
+}
+
+// loadMetadata 把源文件和各清晰度的元数据填入视频
+func loadMetadata(v *Video) error {
+	metadata, err := GetMetadata(v.StorageID())
+	if err != nil {
+		return err
+	}
+	v.Metadata = metadata[MetadataOriginal]
+	if v.Metadata != nil {
+		v.Duration = v.Metadata.Duration
+	}
+	if metadata[MetadataPreview] != nil {
+		v.Preview = fmt.Sprintf("/api/videos/%s/thumbnails/preview.mp4", v.ID)
+	}
+	for i := range v.Qualities {
+		v.Qualities[i].Metadata = metadata[v.Qualities[i].Resolution]
+	}
+	return nil
+}
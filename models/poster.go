@@ -0,0 +1,61 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// 封面来源
+const (
+	PosterSourceFrame  = "frame"  // 从视频的指定时间点截取
+	PosterSourceUpload = "upload" // 用户上传的图片
+)
+
+// PosterVariant 是封面的一个尺寸，图片缩放到 MaxSize 的正方形内，不放大
+type PosterVariant struct {
+	Name    string
+	MaxSize int
+}
+
+var PosterVariants = []PosterVariant{
+	{Name: "large", MaxSize: 1280},
+	{Name: "medium", MaxSize: 640},
+	{Name: "small", MaxSize: 320},
+}
+
+// Poster 是视频设置过的封面，URLs 的键为尺寸名称
+type Poster struct {
+	Source    string            `json:"source"`
+	Timestamp float64           `json:"timestamp,omitempty"` // 截取的时间点（秒），只对 frame 有效
+	URLs      map[string]string `json:"urls"`
+	UpdatedAt time.Time         `json:"updatedAt"`
+}
+
+func newPoster(videoID, source string, timestamp float64, updatedAt time.Time) *Poster {
+	p := &Poster{
+		Source:    source,
+		Timestamp: timestamp,
+		URLs:      make(map[string]string, len(PosterVariants)),
+		UpdatedAt: updatedAt,
+	}
+	// 更换封面后地址不变，带上版本号使浏览器缓存失效
+	for _, variant := range PosterVariants {
+		p.URLs[variant.Name] = fmt.Sprintf("/api/videos/%s/poster/%s?v=%d", videoID, variant.Name, updatedAt.UnixMilli())
+	}
+	return p
+}
+
+// PosterKey 返回封面尺寸在存储中的位置，封面属于视频而不是共用的媒体
+func PosterKey(videoID, variant string) string {
+	return videoID + "/poster/" + variant + ".jpg"
+}
+
+// SetPoster 在封面的各个尺寸写入存储后记录封面来源
+func SetPoster(videoID, source string, timestamp float64) error {
+	now := time.Now()
+	_, err := DB.Exec(`
+		UPDATE videos SET poster_source = ?, poster_timestamp = ?, poster_updated_at = ?, updated_at = ?
+		WHERE id = ?
+	`, source, timestamp, now, now, videoID)
+	return err
+}
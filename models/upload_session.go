@@ -0,0 +1,111 @@
+package models
+
+import (
+	"time"
+)
+
+// 上传协议
+const (
+	UploadProtocolChunked = "chunked"
+	UploadProtocolTus     = "tus"
+)
+
+// 分片上传的传输方式
+const (
+	UploadModeProxy  = "proxy"  // 分片经由本服务写入临时目录
+	UploadModeDirect = "direct" // 客户端用预签名 URL 直接把分片上传到存储
+)
+
+// 上传会话状态
+const (
+	UploadStateActive     = "active"
+	UploadStateAssembling = "assembling" // 分片已齐全，等待后台合并
+	UploadStateCompleted  = "completed"
+	UploadStateAborted    = "aborted"
+	UploadStateExpired    = "expired"
+	UploadStateFailed     = "failed" // 合并后整个文件校验失败
+)
+
+type UploadSession struct {
+	ID          string    `json:"id"`
+	VideoID     string    `json:"videoId"`
+	Protocol    string    `json:"protocol"` // chunked, tus
+	FileName    string    `json:"fileName"`
+	FileSize    int64     `json:"fileSize"`   // 声明的文件大小
+	ChunkSize   int64     `json:"chunkSize"`  // tus 上传为 0
+	ChunkCount  int       `json:"chunkCount"` // tus 上传为 0
+	Checksum    string    `json:"checksum,omitempty"`
+	Mode        string    `json:"mode"` // proxy, direct
+	MultipartID string    `json:"-"`    // direct 模式下存储后端的分段上传 ID
+	Owner       string    `json:"owner"`
+	State       string    `json:"state"` // active, assembling, completed, aborted, expired, failed
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+const uploadSessionColumns = `id, video_id, protocol, file_name, file_size, chunk_size, chunk_count,
+	checksum, mode, multipart_id, owner, state, created_at, updated_at, expires_at`
+
+func scanUploadSession(row rowScanner) (*UploadSession, error) {
+	var u UploadSession
+	err := row.Scan(&u.ID, &u.VideoID, &u.Protocol, &u.FileName, &u.FileSize, &u.ChunkSize, &u.ChunkCount,
+		&u.Checksum, &u.Mode, &u.MultipartID, &u.Owner, &u.State, &u.CreatedAt, &u.UpdatedAt, &u.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// Expired 判断会话是否已超过有效期
+func (u *UploadSession) Expired() bool {
+	return time.Now().After(u.ExpiresAt)
+}
+
+func CreateUploadSession(u *UploadSession) error {
+	_, err := DB.Exec(`
+		INSERT INTO upload_sessions (`+uploadSessionColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, u.ID, u.VideoID, u.Protocol, u.FileName, u.FileSize, u.ChunkSize, u.ChunkCount,
+		u.Checksum, u.Mode, u.MultipartID, u.Owner, u.State, u.CreatedAt, u.UpdatedAt, u.ExpiresAt)
+	return err
+}
+
+func GetUploadSession(id string) (*UploadSession, error) {
+	return scanUploadSession(DB.QueryRow(`SELECT `+uploadSessionColumns+` FROM upload_sessions WHERE id = ?`, id))
+}
+
+// 只有处于 from 状态的会话才会被更新，返回是否更新成功
+func TransitionUploadSession(id, from, to string) (bool, error) {
+	res, err := DB.Exec(`
+		UPDATE upload_sessions SET state = ?, updated_at = ?
+		WHERE id = ? AND state = ?
+	`, to, time.Now(), id, from)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// 获取已过期但仍处于 active 状态的会话
+func GetExpiredUploadSessions(now time.Time) ([]*UploadSession, error) {
+	rows, err := DB.Query(`
+		SELECT `+uploadSessionColumns+` FROM upload_sessions
+		WHERE state = ? AND expires_at < ?
+	`, UploadStateActive, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*UploadSession
+	for rows.Next() {
+		u, err := scanUploadSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, u)
+	}
+	return sessions, rows.Err()
+}
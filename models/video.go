@@ -1,29 +1,59 @@
 package models
 
 import (
+	"database/sql"
+	"errors"
+	"strings"
 	"time"
-
-	"github.com/google/uuid"
+	"video-streaming/events"
 )
 
 type Video struct {
-	ID          string    `json:"id"`
-	Title       string    `json:"title"`
-	FileName    string    `json:"fileName"`
-	FileSize    int64     `json:"fileSize"`
-	ContentType string    `json:"contentType"`
-	Status      string    `json:"status"` // pending, processing, ready, error
-	Qualities   []Quality `json:"qualities"`
-	CreatedAt   time.Time `json:"createdAt"`
-	UpdatedAt   time.Time `json:"updatedAt"`
+	ID          string         `json:"id"`
+	Title       string         `json:"title"`
+	FileName    string         `json:"fileName"`
+	FileSize    int64          `json:"fileSize"`
+	ContentType string         `json:"contentType"`
+	Status      string         `json:"status"`                // pending, processing, ready, error, cancelled
+	ContentHash string         `json:"contentHash,omitempty"` // 原始文件的 SHA-256
+	MediaID     string         `json:"mediaId,omitempty"`     // 共用的媒体，旧数据为空
+	ProfileID   string         `json:"profileId,omitempty"`   // 上传时选择的编码配置，旧数据为空
+	Qualities   []Quality      `json:"qualities"`
+	Duration    float64        `json:"duration,omitempty"` // 源文件时长（秒），未探测时为 0
+	Metadata    *MediaMetadata `json:"metadata,omitempty"` // 源文件的技术参数
+	Poster      *Poster        `json:"poster,omitempty"`   // 设置过的封面，未设置时使用自动生成的缩略图
+	Preview     string         `json:"preview,omitempty"`  // 悬停预览的地址，未生成时为空
+	CreatedAt   time.Time      `json:"createdAt"`
+	UpdatedAt   time.Time      `json:"updatedAt"`
 }
 
 type Quality struct {
-	ID         int64  `json:"id"`
-	VideoID    string `json:"videoId"`
-	Resolution string `json:"resolution"` // 例如: "1080p", "720p", "480p"
-	Path       string `json:"path"`       // 视频文件路径
-	Size       int64  `json:"size"`       // 文件大小
+	ID         int64          `json:"id"`
+	VideoID    string         `json:"videoId"`
+	Resolution string         `json:"resolution"` // 例如: "1080p", "720p", "480p"
+	Width      int            `json:"width"`      // 实际输出宽度，旧数据为 0
+	Height     int            `json:"height"`     // 实际输出高度，旧数据为 0
+	Path       string         `json:"path"`       // 视频文件路径
+	Size       int64          `json:"size"`       // 文件大小
+	Metadata   *MediaMetadata `json:"metadata,omitempty"`
+	Scores     *QualityScores `json:"scores,omitempty"` // 与源视频比较的客观画质，未计算时为 nil
+}
+
+// QualityScores 是清晰度相对源视频的客观画质分数，ffmpeg 不支持的指标为 nil
+type QualityScores struct {
+	VMAF           *float64  `json:"vmaf,omitempty"` // 0-100
+	SSIM           *float64  `json:"ssim,omitempty"` // 0-1
+	PSNR           *float64  `json:"psnr,omitempty"` // dB
+	BelowThreshold bool      `json:"belowThreshold"` // 有指标低于配置的阈值
+	MeasuredAt     time.Time `json:"measuredAt"`
+}
+
+// StorageID 返回视频文件所在的目录名，去重的视频与第一个上传者共用目录
+func (v *Video) StorageID() string {
+	if v.MediaID != "" {
+		return v.MediaID
+	}
+	return v.ID
 }
 
 // 保存视频信息到数据库
@@ -36,9 +66,9 @@ func (v *Video) Save() error {
 
 	// 插入视频信息
 	_, err = tx.Exec(`
-		INSERT INTO videos (id, title, file_name, file_size, content_type, status, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
-	`, v.ID, v.Title, v.FileName, v.FileSize, v.ContentType, v.Status, v.CreatedAt, v.UpdatedAt)
+		INSERT INTO videos (id, title, file_name, file_size, content_type, status, profile_id, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, v.ID, v.Title, v.FileName, v.FileSize, v.ContentType, v.Status, v.ProfileID, v.CreatedAt, v.UpdatedAt)
 	if err != nil {
 		return err
 	}
@@ -46,9 +76,9 @@ func (v *Video) Save() error {
 	// 插入视频质量信息
 	for _, quality := range v.Qualities {
 		_, err = tx.Exec(`
-			INSERT INTO video_qualities (video_id, resolution, path, size)
-			VALUES (?, ?, ?, ?)
-		`, v.ID, quality.Resolution, quality.Path, quality.Size)
+			INSERT INTO video_qualities (video_id, resolution, width, height, path, size)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, v.ID, quality.Resolution, quality.Width, quality.Height, quality.Path, quality.Size)
 		if err != nil {
 			return err
 		}
@@ -57,52 +87,144 @@ func (v *Video) Save() error {
 	return tx.Commit()
 }
 
+const videoColumns = `id, title, file_name, file_size, content_type, status, content_hash, media_id, profile_id,
+	poster_source, poster_timestamp, poster_updated_at, created_at, updated_at`
+
+func scanVideo(row rowScanner) (*Video, error) {
+	var v Video
+	var posterSource string
+	var posterTimestamp float64
+	var posterUpdatedAt sql.NullTime
+	err := row.Scan(&v.ID, &v.Title, &v.FileName, &v.FileSize, &v.ContentType, &v.Status, &v.ContentHash, &v.MediaID, &v.ProfileID,
+		&posterSource, &posterTimestamp, &posterUpdatedAt, &v.CreatedAt, &v.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if posterSource != "" {
+		v.Poster = newPoster(v.ID, posterSource, posterTimestamp, posterUpdatedAt.Time)
+	}
+	return &v, nil
+}
+
 // 从数据库获取视频信息
 func GetVideoByID(id string) (*Video, error) {
-	var v Video
-	err := DB.QueryRow(`
-		SELECT id, title, file_name, file_size, content_type, status, created_at, updated_at
+	v, err := scanVideo(DB.QueryRow(`
+		SELECT `+videoColumns+`
 		FROM videos WHERE id = ?
-	`, id).Scan(&v.ID, &v.Title, &v.FileName, &v.FileSize, &v.ContentType, &v.Status, &v.CreatedAt, &v.UpdatedAt)
+	`, id))
 	if err != nil {
 		return nil, err
 	}
 
-	// 获取视频质量信息
+	// 获取视频质量信息和元数据
+	if err := loadQualities(v); err != nil {
+		return nil, err
+	}
+	if err := loadMetadata(v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// loadQualities 读取视频的清晰度，共用媒体的视频使用媒体的转码结果
+func loadQualities(v *Video) error {
 	rows, err := DB.Query(`
-		SELECT id, video_id, resolution, path, size
+		SELECT id, video_id, resolution, width, height, path, size,
+			vmaf, ssim, psnr, below_threshold, scored_at
 		FROM video_qualities WHERE video_id = ?
-	`, id)
+	`, v.StorageID())
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		var q Quality
-		err := rows.Scan(&q.ID, &q.VideoID, &q.Resolution, &q.Path, &q.Size)
+		var vmaf, ssim, psnr sql.NullFloat64
+		var belowThreshold bool
+		var scoredAt sql.NullTime
+		err := rows.Scan(&q.ID, &q.VideoID, &q.Resolution, &q.Width, &q.Height, &q.Path, &q.Size,
+			&vmaf, &ssim, &psnr, &belowThreshold, &scoredAt)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if scoredAt.Valid {
+			q.Scores = &QualityScores{
+				VMAF:           nullFloat(vmaf),
+				SSIM:           nullFloat(ssim),
+				PSNR:           nullFloat(psnr),
+				BelowThreshold: belowThreshold,
+				MeasuredAt:     scoredAt.Time,
+			}
+		}
+		// 播放地址指向当前视频，媒体的第一个上传者被删除后仍然可用
+		if q.VideoID != v.ID {
+			q.Path = strings.Replace(q.Path, q.VideoID, v.ID, 1)
+			q.VideoID = v.ID
 		}
 		v.Qualities = append(v.Qualities, q)
 	}
-
-	return &v, nil
+	return rows.Err()
 }
 
-// 更新视频状态
+// 更新视频状态并广播状态变化事件
 func UpdateVideoStatus(id, status string) error {
 	_, err := DB.Exec(`
 		UPDATE videos SET status = ?, updated_at = ?
 		WHERE id = ?
 	`, status, time.Now(), id)
-	return err
+	if err != nil {
+		return err
+	}
+	publishStatus(id, status)
+	return nil
+}
+
+// 更新媒体的所有视频的状态，转码任务结束时调用
+func UpdateMediaStatus(mediaID, status string) error {
+	rows, err := DB.Query(`
+		UPDATE videos SET status = ?, updated_at = ?
+		WHERE id = ? OR media_id = ?
+		RETURNING id
+	`, status, time.Now(), mediaID, mediaID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		publishStatus(id, status)
+	}
+	return nil
+}
+
+func publishStatus(id, status string) {
+	eventType := events.VideoStatus
+	switch status {
+	case "ready":
+		eventType = events.VideoReady
+	case "error", "failed":
+		eventType = events.VideoError
+	}
+	events.Publish(eventType, id, map[string]string{"status": status})
 }
 
 // 获取视频列表
 func GetVideoList(limit, offset int) ([]*Video, error) {
 	rows, err := DB.Query(`
-		SELECT id, title, file_name, file_size, content_type, status, created_at, updated_at
+		SELECT `+videoColumns+`
 		FROM videos
 		ORDER BY created_at DESC
 		LIMIT ? OFFSET ?
@@ -114,57 +236,113 @@ func GetVideoList(limit, offset int) ([]*Video, error) {
 
 	var videos []*Video
 	for rows.Next() {
-		var v Video
-		err := rows.Scan(&v.ID, &v.Title, &v.FileName, &v.FileSize, &v.ContentType, &v.Status, &v.CreatedAt, &v.UpdatedAt)
+		v, err := scanVideo(rows)
 		if err != nil {
 			return nil, err
 		}
+		videos = append(videos, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
 
-		// 获取视频质量信息
-		qualityRows, err := DB.Query(`
-			SELECT id, video_id, resolution, path, size
-			FROM video_qualities WHERE video_id = ?
-		`, v.ID)
-		if err != nil {
+	// 获取视频质量信息和元数据
+	for _, v := range videos {
+		if err := loadQualities(v); err != nil {
 			return nil, err
 		}
-		for qualityRows.Next() {
-			var q Quality
-			err := qualityRows.Scan(&q.ID, &q.VideoID, &q.Resolution, &q.Path, &q.Size)
-			if err != nil {
-				qualityRows.Close()
-				return nil, err
-			}
-			v.Qualities = append(v.Qualities, q)
+		if err := loadMetadata(v); err != nil {
+			return nil, err
 		}
-		qualityRows.Close()
-		videos = append(videos, &v)
 	}
 	return videos, nil
 }
 
-func CreateVideo(video *Video) error {
-	video.ID = uuid.New().String()
+func CreateQuality(quality *Quality) error {
+	var vmaf, ssim, psnr *float64
+	var belowThreshold bool
+	var scoredAt *time.Time
+	if s := quality.Scores; s != nil {
+		vmaf, ssim, psnr = s.VMAF, s.SSIM, s.PSNR
+		belowThreshold = s.BelowThreshold
+		scoredAt = &s.MeasuredAt
+	}
 	_, err := DB.Exec(`
-		INSERT INTO videos (id, title, file_name, file_size, content_type, status, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?, datetime('now'), datetime('now'))
-	`, video.ID, video.Title, video.FileName, video.FileSize, video.ContentType, video.Status)
+		INSERT INTO video_qualities (video_id, resolution, width, height, path, size, vmaf, ssim, psnr, below_threshold, scored_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, quality.VideoID, quality.Resolution, quality.Width, quality.Height, quality.Path, quality.Size,
+		vmaf, ssim, psnr, belowThreshold, scoredAt)
 	return err
 }
 
-func UpdateVideo(video *Video) error {
-	_, err := DB.Exec(`
-		UPDATE videos
-		SET status = ?, updated_at = datetime('now')
-		WHERE id = ?
-	`, video.Status, video.ID)
-	return err
+// nullFloat 把可为 NULL 的列转换为指针，NULL 为 nil
+func nullFloat(v sql.NullFloat64) *float64 {
+	if !v.Valid {
+		return nil
+	}
+	return &v.Float64
 }
 
-func CreateQuality(quality *Quality) error {
-	_, err := DB.Exec(`
-		INSERT INTO video_qualities (video_id, resolution, path, size)
-		VALUES (?, ?, ?, ?)
-	`, quality.VideoID, quality.Resolution, quality.Path, quality.Size)
+func DeleteQualities(videoID string) error {
+	_, err := DB.Exec(`DELETE FROM video_qualities WHERE video_id = ?`, videoID)
 	return err
 }
+
+// 删除视频及其任务记录，并释放对媒体的引用
+// 返回需要删除的文件目录名，媒体仍被其他视频使用时返回空字符串
+func DeleteVideo(id string) (string, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var mediaID string
+	if err := tx.QueryRow(`SELECT media_id FROM videos WHERE id = ?`, id).Scan(&mediaID); err != nil {
+		return "", err
+	}
+
+	for _, query := range []string{
+		`DELETE FROM jobs WHERE video_id = ?`,
+		`DELETE FROM videos WHERE id = ?`,
+	} {
+		if _, err := tx.Exec(query, id); err != nil {
+			return "", err
+		}
+	}
+
+	// 旧数据没有媒体记录，文件只属于这个视频
+	released := id
+	if mediaID != "" {
+		var refs int
+		err := tx.QueryRow(`
+			UPDATE media SET ref_count = ref_count - 1, updated_at = ?
+			WHERE id = ?
+			RETURNING ref_count
+		`, time.Now(), mediaID).Scan(&refs)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return "", err
+		}
+		if refs > 0 {
+			return "", tx.Commit()
+		}
+		if _, err := tx.Exec(`DELETE FROM media WHERE id = ?`, mediaID); err != nil {
+			return "", err
+		}
+		released = mediaID
+	}
+
+	// 清晰度、元数据和阶梯分析记录属于媒体，最后一个引用删除时一起删除
+	for _, query := range []string{
+		`DELETE FROM video_qualities WHERE video_id = ?`,
+		`DELETE FROM media_metadata WHERE media_id = ?`,
+		`DELETE FROM ladder_rungs WHERE media_id = ?`,
+		`DELETE FROM ladder_analyses WHERE media_id = ?`,
+	} {
+		if _, err := tx.Exec(query, released); err != nil {
+			return "", err
+		}
+	}
+	return released, tx.Commit()
+}
@@ -0,0 +1,87 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+	"video-streaming/storage"
+)
+
+// 支持的校验算法
+const (
+	ChecksumSHA256 = "sha256"
+	ChecksumCRC32C = "crc32c"
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Checksum 是客户端声明的校验值，文本格式为 "sha256:<hex>" 或 "crc32c:<hex>"
+type Checksum struct {
+	Algorithm string
+	Sum       []byte
+}
+
+// ParseChecksum 解析校验值，没有算法前缀时按 sha256 处理
+func ParseChecksum(s string) (*Checksum, error) {
+	algorithm, value, ok := strings.Cut(strings.TrimSpace(s), ":")
+	if !ok {
+		algorithm, value = ChecksumSHA256, algorithm
+	}
+	algorithm = strings.ToLower(algorithm)
+
+	sum, err := hex.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid checksum value %q", value)
+	}
+
+	c := &Checksum{Algorithm: algorithm, Sum: sum}
+	h := c.NewHash()
+	if h == nil {
+		return nil, fmt.Errorf("unsupported checksum algorithm %q", algorithm)
+	}
+	if len(sum) != h.Size() {
+		return nil, fmt.Errorf("invalid %s checksum length", algorithm)
+	}
+	return c, nil
+}
+
+// NewHash 返回对应算法的哈希，算法不支持时返回 nil
+func (c *Checksum) NewHash() hash.Hash {
+	switch c.Algorithm {
+	case ChecksumSHA256:
+		return sha256.New()
+	case ChecksumCRC32C:
+		return crc32.New(crc32cTable)
+	}
+	return nil
+}
+
+// Matches 比较计算结果与声明的校验值
+func (c *Checksum) Matches(h hash.Hash) bool {
+	return bytes.Equal(h.Sum(nil), c.Sum)
+}
+
+func (c *Checksum) String() string {
+	return c.Algorithm + ":" + hex.EncodeToString(c.Sum)
+}
+
+// objectSHA256 计算存储中对象的 SHA-256，返回十六进制字符串
+func objectSHA256(ctx context.Context, s storage.Storage, key string) (string, error) {
+	r, err := s.Get(ctx, key, 0, -1)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,304 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"video-streaming/models"
+)
+
+// 清晰度名称用作文件名和 quality 参数，只允许安全的字符
+var renditionNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+var (
+	videoCodecs = []string{"libx264", "libx265"}
+	// libx264 和 libx265 的预设名称相同
+	encoderPresets = []string{"ultrafast", "superfast", "veryfast", "faster", "fast", "medium", "slow", "slower", "veryslow", "placebo"}
+	containers     = []string{"mp4", "fmp4"}
+
+	rateControls = []string{models.RateControlCRF, models.RateControlTwoPass, models.RateControlCQ}
+)
+
+// ValidateProfile 检查编码配置并为未填写的字段设置默认值
+func ValidateProfile(p *models.EncodingProfile) error {
+	p.Name = strings.TrimSpace(p.Name)
+	if p.Name == "" || len(p.Name) > 64 {
+		return fmt.Errorf("name must be 1 to 64 characters")
+	}
+	if len(p.Renditions) == 0 {
+		return fmt.Errorf("at least one rendition is required")
+	}
+
+	seen := make(map[string]bool)
+	for i := range p.Renditions {
+		r := &p.Renditions[i]
+		if !renditionNamePattern.MatchString(r.Name) {
+			return fmt.Errorf("rendition %d: name must match %s", i, renditionNamePattern)
+		}
+		if r.Name == models.MetadataOriginal || r.Name == models.MetadataPreview || seen[r.Name] {
+			return fmt.Errorf("rendition %s: duplicate or reserved name", r.Name)
+		}
+		seen[r.Name] = true
+		if err := validateRendition(r); err != nil {
+			return fmt.Errorf("rendition %s: %v", r.Name, err)
+		}
+	}
+	return nil
+}
+
+func validateRendition(r *models.Rendition) error {
+	// H.264 4:2:0 要求宽高为偶数
+	if r.Width <= 0 || r.Height <= 0 || r.Width%2 != 0 || r.Height%2 != 0 {
+		return fmt.Errorf("width and height must be positive even numbers")
+	}
+
+	if r.VideoCodec == "" {
+		r.VideoCodec = "libx264"
+	}
+	if !slices.Contains(videoCodecs, r.VideoCodec) {
+		return fmt.Errorf("videoCodec must be one of %s", strings.Join(videoCodecs, ", "))
+	}
+	if r.Preset == "" {
+		r.Preset = "medium"
+	}
+	if !slices.Contains(encoderPresets, r.Preset) {
+		return fmt.Errorf("unknown preset %q", r.Preset)
+	}
+	if r.CRF < 0 || r.CRF > 51 {
+		return fmt.Errorf("crf must be between 0 and 51")
+	}
+	for _, v := range []string{r.Bitrate, r.MaxRate, r.BufSize} {
+		if v == "" {
+			continue
+		}
+		if _, err := ParseBitrate(v); err != nil {
+			return fmt.Errorf("bitrate/maxrate/bufsize: %v", err)
+		}
+	}
+
+	r.RateControl = rateControl(*r)
+	switch r.RateControl {
+	case models.RateControlCRF:
+		if r.CRF == 0 {
+			return fmt.Errorf("crf mode requires crf")
+		}
+		if r.MaxRate == "" && r.Bitrate == "" {
+			return fmt.Errorf("crf mode requires maxrate, or bitrate as the cap")
+		}
+		// 按 CRF 编码时不设置目标码率，bitrate 只作为 maxrate 的默认值
+		r.MaxRate, r.BufSize = rateCaps(*r)
+		r.Bitrate = ""
+	case models.RateControlTwoPass:
+		if r.Bitrate == "" {
+			return fmt.Errorf("2pass mode requires bitrate")
+		}
+		if r.CRF != 0 {
+			return fmt.Errorf("crf cannot be used with 2pass mode")
+		}
+		if (r.MaxRate == "") != (r.BufSize == "") {
+			return fmt.Errorf("maxrate and bufsize must be set together")
+		}
+	case models.RateControlCQ:
+		if r.CRF == 0 {
+			return fmt.Errorf("cq mode requires crf")
+		}
+		if r.Bitrate != "" || r.MaxRate != "" || r.BufSize != "" {
+			return fmt.Errorf("cq mode does not use bitrate, maxrate or bufsize")
+		}
+	default:
+		return fmt.Errorf("rateControl must be one of %s", strings.Join(rateControls, ", "))
+	}
+
+	if r.AudioBitrate == "" {
+		r.AudioBitrate = "128k"
+	}
+	if _, err := ParseBitrate(r.AudioBitrate); err != nil {
+		return fmt.Errorf("audioBitrate: %v", err)
+	}
+	if r.Container == "" {
+		r.Container = "mp4"
+	}
+	if !slices.Contains(containers, r.Container) {
+		return fmt.Errorf("container must be one of %s", strings.Join(containers, ", "))
+	}
+	return nil
+}
+
+// fitRenditions 按源视频的显示尺寸调整阶梯，返回实际输出尺寸的清晰度
+// 配置中的宽高是横屏的外框，竖屏视频使用交换后的外框。保持宽高比缩放到外框内，
+// 需要放大的清晰度被跳过；源视频比最低清晰度还小时按原尺寸输出最低清晰度
+func fitRenditions(src *SourceInfo, renditions []models.Rendition) []models.Rendition {
+	srcW, srcH := src.DisplaySize()
+
+	var fitted []models.Rendition
+	seen := make(map[[2]int]bool)
+	for _, r := range renditions {
+		boxW, boxH := r.Width, r.Height
+		if (srcH > srcW) != (boxH > boxW) {
+			boxW, boxH = boxH, boxW
+		}
+		scale := math.Min(float64(boxW)/float64(srcW), float64(boxH)/float64(srcH))
+		if scale > 1 {
+			continue
+		}
+		r.Width, r.Height = evenSize(float64(srcW)*scale), evenSize(float64(srcH)*scale)
+		// 宽高比很特殊时不同外框可能得到相同的尺寸
+		if seen[[2]int{r.Width, r.Height}] {
+			continue
+		}
+		seen[[2]int{r.Width, r.Height}] = true
+		fitted = append(fitted, r)
+	}
+
+	if len(fitted) == 0 && len(renditions) > 0 {
+		smallest := renditions[0]
+		for _, r := range renditions[1:] {
+			if r.Width*r.Height < smallest.Width*smallest.Height {
+				smallest = r
+			}
+		}
+		smallest.Width, smallest.Height = evenSize(float64(srcW)), evenSize(float64(srcH))
+		fitted = append(fitted, smallest)
+	}
+	return fitted
+}
+
+// evenSize 取整到不大于它的偶数，4:2:0 编码要求宽高为偶数
+func evenSize(v float64) int {
+	return max(int(math.Round(v))/2*2, 2)
+}
+
+// encodeArgs 返回按清晰度配置编码的 ffmpeg 输出参数，不包含输入和输出路径
+// r 的宽高是 fitRenditions 计算出的实际输出尺寸，fps 用于设置 GOP 长度，未知时传 0
+func encodeArgs(r models.Rendition, fps float64) []string {
+	return append([]string{"-vf", scaleFilter(r)}, codecArgs(r, fps)...)
+}
+
+// scaleFilter 返回把画面缩放到清晰度输出尺寸的滤镜
+// ffmpeg 读取时已按旋转信息转正，缩放到显示尺寸后输出方形像素
+func scaleFilter(r models.Rendition) string {
+	return fmt.Sprintf("scale=%d:%d,setsar=1", r.Width, r.Height)
+}
+
+// rateControl 返回清晰度的码率控制模式
+// 没有设置模式的旧配置按原来的参数推断：设置了 CRF 的是 crf 模式，否则是 2pass
+func rateControl(r models.Rendition) string {
+	switch {
+	case r.RateControl != "":
+		return r.RateControl
+	case r.CRF > 0:
+		return models.RateControlCRF
+	default:
+		return models.RateControlTwoPass
+	}
+}
+
+// rateCaps 返回 maxrate 和 bufsize，crf 模式未设置时 maxrate 取 bitrate，bufsize 取两倍 maxrate
+func rateCaps(r models.Rendition) (maxRate, bufSize string) {
+	maxRate, bufSize = r.MaxRate, r.BufSize
+	if rateControl(r) != models.RateControlCRF {
+		return maxRate, bufSize
+	}
+	if maxRate == "" {
+		maxRate = r.Bitrate
+	}
+	if bufSize == "" {
+		if bps, err := ParseBitrate(maxRate); err == nil {
+			bufSize = fmt.Sprintf("%dk", bps*2/1000)
+		}
+	}
+	return maxRate, bufSize
+}
+
+// encodePasses 返回清晰度需要的编码遍数
+func encodePasses(r models.Rendition) int {
+	if rateControl(r) == models.RateControlTwoPass {
+		return 2
+	}
+	return 1
+}
+
+// codecArgs 返回编码器、码率控制、关键帧和封装参数，不包含滤镜
+// 两遍编码的第二遍还需要加上 passArgs
+func codecArgs(r models.Rendition, fps float64) []string {
+	args := videoCodecArgs(r, fps)
+	args = append(args, "-c:a", "aac", "-b:a", r.AudioBitrate)
+
+	if r.Container == "fmp4" {
+		args = append(args, "-movflags", "+frag_keyframe+empty_moov+default_base_moof")
+	} else {
+		args = append(args, "-movflags", "+faststart") // 确保 moov atom 在文件开头
+	}
+	return append(args, "-f", "mp4")
+}
+
+// firstPassArgs 返回两遍编码第一遍的参数，只分析画面，输出路径应为 os.DevNull
+func firstPassArgs(r models.Rendition, fps float64, passLog string) []string {
+	args := append(videoCodecArgs(r, fps), passArgs(r, 1, passLog)...)
+	return append(args, "-an", "-f", "null")
+}
+
+// passArgs 返回两遍编码中第 pass 遍的参数，passLog 是两遍共用的统计文件前缀
+func passArgs(r models.Rendition, pass int, passLog string) []string {
+	// libx265 不支持 -pass，统计文件通过编码器参数指定
+	if r.VideoCodec == "libx265" {
+		return []string{"-x265-params", fmt.Sprintf("pass=%d:stats=%s.log", pass, passLog)}
+	}
+	return []string{"-pass", fmt.Sprint(pass), "-passlogfile", passLog}
+}
+
+// videoCodecArgs 返回视频编码器、码率控制和关键帧参数
+func videoCodecArgs(r models.Rendition, fps float64) []string {
+	args := []string{"-c:v", r.VideoCodec, "-preset", r.Preset}
+	switch r.VideoCodec {
+	case "libx264":
+		args = append(args, "-profile:v", "main", "-level", "4.0")
+	case "libx265":
+		// Apple 设备只识别 hvc1 标签的 HEVC
+		args = append(args, "-tag:v", "hvc1")
+	}
+
+	// -crf 和 -b:v 同时设置时编码器的行为因版本而异，每种模式只使用自己的参数
+	maxRate, bufSize := rateCaps(r)
+	switch rateControl(r) {
+	case models.RateControlCRF:
+		args = append(args, "-crf", fmt.Sprint(r.CRF))
+		if maxRate != "" {
+			args = append(args, "-maxrate", maxRate, "-bufsize", bufSize)
+		}
+	case models.RateControlTwoPass:
+		args = append(args, "-b:v", r.Bitrate)
+		if maxRate != "" {
+			args = append(args, "-maxrate", maxRate, "-bufsize", bufSize)
+		}
+	case models.RateControlCQ:
+		args = append(args, "-crf", fmt.Sprint(r.CRF))
+	}
+
+	args = append(args,
+		// 固定 2 秒一个关键帧，保证各清晰度的切片边界对齐
+		"-force_key_frames", "expr:gte(t,n_forced*2)",
+		"-sc_threshold", "0",
+	)
+	if fps > 0 {
+		args = append(args, "-g", fmt.Sprint(int(math.Round(fps*2))))
+	}
+	return args
+}
+
+// passLogPrefix 返回清晰度两遍编码统计文件的路径前缀
+func passLogPrefix(dir, name string) string {
+	return filepath.Join(dir, name+"-passlog")
+}
+
+// removePassLogs 删除两遍编码的统计文件，避免和转码结果一起写入存储
+func removePassLogs(passLog string) {
+	matches, _ := filepath.Glob(passLog + "*")
+	for _, m := range matches {
+		os.Remove(m)
+	}
+}
@@ -0,0 +1,94 @@
+package services
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"video-streaming/models"
+)
+
+func TestFitRenditions(t *testing.T) {
+	tests := []struct {
+		name       string
+		source     SourceInfo
+		renditions []models.Rendition
+		want       []string
+	}{
+		{"landscape", SourceInfo{Width: 1920, Height: 1080}, ladderRenditions,
+			[]string{"1080p 1920x1080", "720p 1280x720", "480p 852x480"}},
+		{"4k", SourceInfo{Width: 3840, Height: 2160}, ladderRenditions,
+			[]string{"1080p 1920x1080", "720p 1280x720", "480p 852x480"}},
+		// 竖屏使用交换后的外框
+		{"portrait", SourceInfo{Width: 1080, Height: 1920}, ladderRenditions,
+			[]string{"1080p 1080x1920", "720p 720x1280", "480p 480x852"}},
+		{"rotated 90", SourceInfo{Width: 1920, Height: 1080, Rotation: 90}, ladderRenditions,
+			[]string{"1080p 1080x1920", "720p 720x1280", "480p 480x852"}},
+		{"rotated 180", SourceInfo{Width: 1280, Height: 720, Rotation: 180}, ladderRenditions,
+			[]string{"720p 1280x720", "480p 852x480"}},
+		// 非方形像素按显示尺寸计算
+		{"anamorphic 1080", SourceInfo{Width: 1440, Height: 1080, SARNum: 4, SARDen: 3}, ladderRenditions,
+			[]string{"1080p 1920x1080", "720p 1280x720", "480p 852x480"}},
+		{"pal 4:3", SourceInfo{Width: 720, Height: 576, SARNum: 16, SARDen: 15}, ladderRenditions,
+			[]string{"480p 640x480"}},
+		{"anamorphic rotated", SourceInfo{Width: 1440, Height: 1080, SARNum: 4, SARDen: 3, Rotation: 270}, ladderRenditions,
+			[]string{"1080p 1080x1920", "720p 720x1280", "480p 480x852"}},
+		// 比最低清晰度还小时按原尺寸输出最低清晰度，奇数尺寸取偶数
+		{"below lowest rung", SourceInfo{Width: 640, Height: 360}, ladderRenditions,
+			[]string{"480p 640x360"}},
+		{"odd size", SourceInfo{Width: 639, Height: 359}, ladderRenditions,
+			[]string{"480p 638x358"}},
+		{"portrait below lowest rung", SourceInfo{Width: 360, Height: 640}, ladderRenditions,
+			[]string{"480p 360x640"}},
+		// 不同外框得到相同尺寸时只保留第一个
+		{"duplicate size", SourceInfo{Width: 1920, Height: 1080},
+			[]models.Rendition{{Name: "720p", Width: 1280, Height: 720}, {Name: "960p", Width: 1280, Height: 960}},
+			[]string{"720p 1280x720"}},
+		{"empty ladder", SourceInfo{Width: 1920, Height: 1080}, nil, nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, r := range fitRenditions(&tt.source, tt.renditions) {
+			got = append(got, fmt.Sprintf("%s %dx%d", r.Name, r.Width, r.Height))
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: fitRenditions = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSourceInfo(t *testing.T) {
+	// 显示矩阵的角度是逆时针的，旧版 ffprobe 的 rotate 标签是顺时针的
+	matrix := ProbeStream{Width: 1920, Height: 1080, AvgFrameRate: "30/1"}
+	matrix.SideDataList = append(matrix.SideDataList, struct {
+		Rotation float64 `json:"rotation"`
+	}{Rotation: -90})
+	tagged := ProbeStream{Width: 1920, Height: 1080, AvgFrameRate: "0/0", RFrameRate: "25/1"}
+	tagged.Tags.Rotate = "270"
+
+	tests := []struct {
+		name     string
+		stream   ProbeStream
+		want     SourceInfo
+		displayW int
+		displayH int
+	}{
+		{"plain", ProbeStream{Width: 1920, Height: 1080, SampleAspectRatio: "1:1", AvgFrameRate: "30000/1001"},
+			SourceInfo{Width: 1920, Height: 1080, SARNum: 1, SARDen: 1, FPS: 30000.0 / 1001}, 1920, 1080},
+		{"display matrix", matrix,
+			SourceInfo{Width: 1920, Height: 1080, Rotation: 90, SARNum: 1, SARDen: 1, FPS: 30}, 1080, 1920},
+		// avg_frame_rate 无效时使用 r_frame_rate
+		{"rotate tag", tagged,
+			SourceInfo{Width: 1920, Height: 1080, Rotation: 270, SARNum: 1, SARDen: 1, FPS: 25}, 1080, 1920},
+		{"anamorphic", ProbeStream{Width: 1440, Height: 1080, SampleAspectRatio: "4:3", AvgFrameRate: "25/1"},
+			SourceInfo{Width: 1440, Height: 1080, SARNum: 4, SARDen: 3, FPS: 25}, 1920, 1080},
+		{"unknown sar", ProbeStream{Width: 1280, Height: 720, SampleAspectRatio: "0:1", AvgFrameRate: "24/1"},
+			SourceInfo{Width: 1280, Height: 720, SARNum: 1, SARDen: 1, FPS: 24}, 1280, 720},
+	}
+	for _, tt := range tests {
+		info := tt.stream.sourceInfo()
+		w, h := info.DisplaySize()
+		if *info != tt.want || w != tt.displayW || h != tt.displayH {
+			t.Errorf("%s: got %+v display %dx%d, want %+v display %dx%d", tt.name, *info, w, h, tt.want, tt.displayW, tt.displayH)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// 这些扩展名的参数被 FakeFFmpeg 视为输出文件
+var fakeOutputExts = []string{".mp4", ".jpg", ".png", ".webp", ".m3u8", ".mpd", ".ts", ".m4s"}
+
+// 画质比较滤镜的统计文件内容，FakeFFmpeg 按滤镜参数写入
+var fakeStatsFiles = map[string]string{
+	"ssim=stats_file=":               "n:1 Y:0.980000 U:0.990000 V:0.990000 All:0.985000 (18.239)\n",
+	"psnr=stats_file=":               "n:1 mse_avg:10.00 mse_y:12.00 mse_u:6.00 mse_v:6.00 psnr_avg:38.13 psnr_y:37.34 psnr_u:40.35 psnr_v:40.35\n",
+	"libvmaf=log_fmt=json:log_path=": `{"pooled_metrics": {"vmaf": {"mean": 90.0}}}`,
+}
+
+// FakeFFmpeg 是不依赖本机 ffmpeg 和 ffprobe 的 Prober 和 Encoder，结果只取决于参数，用于测试
+// 把 MediaProber 和 MediaEncoder 设置为同一个 FakeFFmpeg 即可运行整个处理流程
+type FakeFFmpeg struct {
+	// Result 是 Probe 返回的固定结果，由 FakeProbeResult 生成
+	Result *ProbeResult
+	// RunErr 不为 nil 时 Run 不写任何文件，直接返回该错误
+	RunErr error
+
+	mu    sync.Mutex
+	calls [][]string
+}
+
+// NewFakeFFmpeg 返回探测结果为 10 秒 1920x1080 带音轨视频的 FakeFFmpeg
+func NewFakeFFmpeg() *FakeFFmpeg {
+	return &FakeFFmpeg{Result: FakeProbeResult(10, 1920, 1080)}
+}
+
+// FakeProbeResult 返回 H.264/AAC MP4 的探测结果
+func FakeProbeResult(duration float64, width, height int) *ProbeResult {
+	return &ProbeResult{
+		Streams: []ProbeStream{
+			{
+				CodecType:         "video",
+				CodecName:         "h264",
+				Profile:           "Main",
+				Level:             40,
+				Width:             width,
+				Height:            height,
+				PixFmt:            "yuv420p",
+				SampleAspectRatio: "1:1",
+				AvgFrameRate:      "30/1",
+				RFrameRate:        "30/1",
+				BitRate:           "2000000",
+			},
+			{
+				CodecType:     "audio",
+				CodecName:     "aac",
+				Profile:       "LC",
+				Level:         -99,
+				SampleRate:    "48000",
+				Channels:      2,
+				ChannelLayout: "stereo",
+				BitRate:       "128000",
+			},
+		},
+		Format: ProbeFormat{
+			FormatName: "mov,mp4,m4a,3gp,3g2,mj2",
+			Duration:   fmt.Sprintf("%.6f", duration),
+			Size:       "1000000",
+			BitRate:    "2128000",
+		},
+	}
+}
+
+// Probe 对存在的本地文件和任何 URL 返回 Result，本地文件不存在时返回错误
+func (f *FakeFFmpeg) Probe(location string) (*ProbeResult, error) {
+	if !strings.Contains(location, "://") {
+		if _, err := os.Stat(location); err != nil {
+			return nil, fmt.Errorf("ffprobe error: %v", err)
+		}
+	}
+	result := *f.Result
+	result.Streams = slices.Clone(f.Result.Streams)
+	return &result, nil
+}
+
+// Run 记录参数，为每个输出文件写入占位内容，并以 Result 的时长报告一次完成进度
+// 不跟在 -i 后面、包含目录且扩展名为视频、图片或清单的参数视为输出，
+// 序号模板如 segment_%03d.ts 写入序号为 1 的文件
+func (f *FakeFFmpeg) Run(args []string, progress func(p FFmpegProgress)) error {
+	f.mu.Lock()
+	f.calls = append(f.calls, slices.Clone(args))
+	f.mu.Unlock()
+
+	if f.RunErr != nil {
+		return f.RunErr
+	}
+
+	for i, arg := range args {
+		if i > 0 && args[i-1] == "-i" {
+			continue
+		}
+		if i > 0 && (args[i-1] == "-lavfi" || args[i-1] == "-filter_complex") {
+			if err := writeFakeStats(arg); err != nil {
+				return err
+			}
+			continue
+		}
+		if !strings.Contains(arg, string(filepath.Separator)) || !slices.Contains(fakeOutputExts, filepath.Ext(arg)) {
+			continue
+		}
+		path := arg
+		if strings.Contains(path, "%") {
+			path = fmt.Sprintf(path, 1)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, []byte("fake "+filepath.Base(path)), 0644); err != nil {
+			return err
+		}
+	}
+
+	if progress != nil {
+		duration := parseFloat(f.Result.Format.Duration)
+		progress(FFmpegProgress{OutTime: duration, Speed: 1, Done: true})
+	}
+	return nil
+}
+
+// Calls 返回 Run 收到的所有参数，按调用顺序排列
+func (f *FakeFFmpeg) Calls() [][]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.calls)
+}
+
+// writeFakeStats 为滤镜图中的 ssim、psnr 和 libvmaf 写入固定的统计文件
+// 和 ffmpeg 一样先按滤镜图、再按选项去除路径的转义
+func writeFakeStats(filter string) error {
+	for _, part := range splitFilterGraph(filter) {
+		for prefix, content := range fakeStatsFiles {
+			_, path, ok := strings.Cut(part, prefix)
+			if !ok {
+				continue
+			}
+			if err := os.WriteFile(unescapeFilter(unescapeFilter(path)), []byte(content), 0644); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// splitFilterGraph 按没有转义且不在单引号中的 ; 分割滤镜图，各部分保留转义
+func splitFilterGraph(graph string) []string {
+	var parts []string
+	start, quoted := 0, false
+	for i := 0; i < len(graph); i++ {
+		switch graph[i] {
+		case '\\':
+			if !quoted {
+				i++
+			}
+		case '\'':
+			quoted = !quoted
+		case ';':
+			if !quoted {
+				parts = append(parts, graph[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, graph[start:])
+}
+
+// unescapeFilter 去除一层 ffmpeg 的转义：\ 后的字符原样保留，单引号之间的内容不转义
+func unescapeFilter(s string) string {
+	var b strings.Builder
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\'':
+			quoted = !quoted
+		case c == '\\' && !quoted && i+1 < len(s):
+			i++
+			b.WriteByte(s[i])
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,88 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+)
+
+// Prober 读取媒体文件的格式和流信息，location 可以是文件路径或 URL
+type Prober interface {
+	Probe(location string) (*ProbeResult, error)
+}
+
+// Encoder 运行一次 ffmpeg，args 不包含程序名
+// progress 不为 nil 时接收 -progress 输出的每个数据块
+type Encoder interface {
+	Run(args []string, progress func(p FFmpegProgress)) error
+}
+
+// 所有 ffprobe 和 ffmpeg 调用都经过这两个实现，默认调用本机的程序，测试中替换为 FakeFFmpeg
+var (
+	MediaProber  Prober  = ExecProber{}
+	MediaEncoder Encoder = ExecEncoder{}
+)
+
+// ExecProber 调用 ffprobe 读取 JSON 格式的格式和流信息
+type ExecProber struct{}
+
+func (ExecProber) Probe(location string) (*ProbeResult, error) {
+	cmd := exec.Command("ffprobe",
+		"-v", "error",
+		"-show_format",
+		"-show_streams",
+		"-of", "json",
+		location,
+	)
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe error: %v", err)
+	}
+
+	var result ProbeResult
+	if err := json.Unmarshal(output, &result); err != nil {
+		return nil, fmt.Errorf("invalid ffprobe output: %v", err)
+	}
+	return &result, nil
+}
+
+// ExecEncoder 调用 ffmpeg，失败时错误中包含 ffmpeg 的输出
+type ExecEncoder struct{}
+
+func (ExecEncoder) Run(args []string, progress func(p FFmpegProgress)) error {
+	if progress == nil {
+		output, err := exec.Command("ffmpeg", args...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("ffmpeg error: %v\nOutput: %s", err, string(output))
+		}
+		return nil
+	}
+
+	args = append([]string{"-progress", "pipe:1", "-nostats"}, args...)
+	cmd := exec.Command("ffmpeg", args...)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to get ffmpeg stdout: %v", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start ffmpeg: %v", err)
+	}
+	parseErr := parseFFmpegProgress(stdout, progress)
+	// 解析失败时也要读完输出，避免 ffmpeg 阻塞
+	io.Copy(io.Discard, stdout)
+
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("ffmpeg error: %v\nOutput: %s", err, stderr.String())
+	}
+	if parseErr != nil {
+		return fmt.Errorf("failed to read ffmpeg progress: %v", parseErr)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+	"video-streaming/models"
+)
+
+// JobHandler 处理某一类型的任务，返回错误表示任务失败
+type JobHandler func(job *models.Job) error
+
+// JobQueue 是基于 SQLite jobs 表的持久化任务队列
+// 每种任务类型由各自固定数量的工作协程消费
+type JobQueue struct {
+	PollInterval time.Duration
+
+	types map[string]*jobType
+}
+
+type jobType struct {
+	name    string
+	workers int
+	handler JobHandler
+	wake    chan struct{}
+}
+
+func NewJobQueue() *JobQueue {
+	return &JobQueue{
+		PollInterval: 5 * time.Second,
+		types:        make(map[string]*jobType),
+	}
+}
+
+// Register 为任务类型注册处理函数和工作协程数，必须在 Start 之前调用
+func (q *JobQueue) Register(name string, workers int, handler JobHandler) {
+	if workers < 1 {
+		workers = 1
+	}
+	q.types[name] = &jobType{
+		name:    name,
+		workers: workers,
+		handler: handler,
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Enqueue 写入一个排队任务并唤醒空闲的工作协程
+func (q *JobQueue) Enqueue(videoID, name string) (*models.Job, error) {
+	t, ok := q.types[name]
+	if !ok {
+		return nil, fmt.Errorf("no handler registered for job type %s", name)
+	}
+	job, err := models.CreateJob(videoID, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create job: %v", err)
+	}
+	t.notify()
+	return job, nil
+}
+
+// Start 恢复上次中断的任务并启动工作协程
+func (q *JobQueue) Start() error {
+	n, err := models.RequeueRunningJobs()
+	if err != nil {
+		return fmt.Errorf("failed to requeue running jobs: %v", err)
+	}
+	if n > 0 {
+		log.Printf("Requeued %d interrupted jobs", n)
+	}
+
+	// 旧版本没有任务表，处于 processing 的视频需要补建转码任务
+	videoIDs, err := models.GetOrphanedProcessingVideos()
+	if err != nil {
+		return fmt.Errorf("failed to find orphaned videos: %v", err)
+	}
+	for _, videoID := range videoIDs {
+		if _, err := q.Enqueue(videoID, models.JobTypeTranscode); err != nil {
+			return err
+		}
+		log.Printf("Requeued transcoding for video %s", videoID)
+	}
+
+	for _, t := range q.types {
+		for i := 0; i < t.workers; i++ {
+			go q.worker(t, i)
+		}
+		log.Printf("Job queue started %d %s workers", t.workers, t.name)
+	}
+	return nil
+}
+
+func (t *jobType) notify() {
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *JobQueue) worker(t *jobType, id int) {
+	ticker := time.NewTicker(q.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		job, err := models.ClaimNextJob(t.name)
+		if errors.Is(err, sql.ErrNoRows) {
+			select {
+			case <-t.wake:
+			case <-ticker.C:
+			}
+			continue
+		}
+		if err != nil {
+			log.Printf("%s worker %d failed to claim job: %v", t.name, id, err)
+			<-ticker.C
+			continue
+		}
+
+		// 还有任务时继续唤醒其他空闲协程
+		t.notify()
+		q.run(t, id, job)
+	}
+}
+
+func (q *JobQueue) run(t *jobType, workerID int, job *models.Job) {
+	log.Printf("%s worker %d running job %s for video %s (attempt %d)",
+		t.name, workerID, job.ID, job.VideoID, job.Attempts)
+
+	err := handleJob(t.handler, job)
+	status, errMsg := models.JobStatusSucceeded, ""
+	if err != nil {
+		status, errMsg = models.JobStatusFailed, err.Error()
+		log.Printf("Job %s failed: %v", job.ID, err)
+	}
+	if err := models.FinishJob(job.ID, status, errMsg); err != nil {
+		log.Printf("Failed to update job %s: %v", job.ID, err)
+	}
+}
+
+func handleJob(handler JobHandler, job *models.Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+	return handler(job)
+}
@@ -0,0 +1,211 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"video-streaming/models"
+)
+
+const (
+	// 试编码从视频中均匀截取几段，缩放到不超过该外框的尺寸
+	trialSamples      = 3
+	trialSampleLength = 4.0 // 秒
+	trialMaxWidth     = 960
+	trialMaxHeight    = 540
+
+	// 2pass 模式没有 CRF，按参考 CRF 的码率选择目标码率，复杂度也按参考 CRF 计算
+	referenceCRF = 23
+	// 码率和像素数近似为幂函数关系，分辨率翻倍码率不到翻倍
+	pixelExponent = 0.75
+	// libx265 达到相同画质的码率约为 libx264 的七成
+	x265BitrateFactor = 0.7
+	// crf 模式的 maxrate 是预测平均码率的倍数，给复杂画面留出余量
+	crfCapHeadroom = 1.5
+	// 选择的码率限制在配置码率的这个范围内，分析结果异常时不至于偏离太远
+	minLadderScale = 0.25
+	maxLadderScale = 1.5
+)
+
+// 试编码使用的 CRF，由高画质到低画质
+var trialCRFs = []int{20, 26, 32}
+
+// analyzeLadder 用几个 CRF 快速试编码源视频的片段，按码率随 CRF 的变化估计每个清晰度需要的码率，
+// 返回调整了码率的清晰度和分析结果。renditions 是 fitRenditions 的结果
+func (s *TranscodeService) analyzeLadder(inputPath, videoID string, source *SourceInfo, duration float64, renditions []models.Rendition) ([]models.Rendition, *models.LadderAnalysis, error) {
+	if duration <= 0 {
+		return nil, nil, fmt.Errorf("unknown duration")
+	}
+	trial := fitRenditions(source, []models.Rendition{{Width: trialMaxWidth, Height: trialMaxHeight}})[0]
+
+	workDir, err := os.MkdirTemp(s.BaseDir, "ladder-")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create work directory: %v", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	// 所有 CRF 共用一次解码，片段拼接后用 split 分给各个编码器
+	var args []string
+	var filter strings.Builder
+	ranges := sampleRanges(duration, trialSamples, trialSampleLength)
+	for i, r := range ranges {
+		args = append(args, "-ss", fmt.Sprintf("%.3f", r[0]), "-t", fmt.Sprintf("%.3f", r[1]), "-i", inputPath)
+		fmt.Fprintf(&filter, "[%d:v]%s,setpts=PTS-STARTPTS[c%d];", i, scaleFilter(trial), i)
+	}
+	for i := range ranges {
+		fmt.Fprintf(&filter, "[c%d]", i)
+	}
+	fmt.Fprintf(&filter, "concat=n=%d:v=1:a=0,split=%d", len(ranges), len(trialCRFs))
+	for i := range trialCRFs {
+		fmt.Fprintf(&filter, "[t%d]", i)
+	}
+	args = append(args, "-filter_complex", filter.String())
+
+	outputs := make([]string, len(trialCRFs))
+	for i, crf := range trialCRFs {
+		outputs[i] = filepath.Join(workDir, fmt.Sprintf("crf%d.mp4", crf))
+		args = append(args,
+			"-map", fmt.Sprintf("[t%d]", i),
+			"-an",
+			"-c:v", "libx264",
+			"-preset", "veryfast",
+			"-crf", fmt.Sprint(crf),
+			"-y",
+			outputs[i],
+		)
+	}
+	if err := MediaEncoder.Run(args, nil); err != nil {
+		return nil, nil, fmt.Errorf("trial encode failed: %v", err)
+	}
+
+	trials := make([]models.TrialEncode, len(trialCRFs))
+	for i, crf := range trialCRFs {
+		_, metadata, err := probeMedia(outputs[i])
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to probe trial encode at crf %d: %v", crf, err)
+		}
+		bitrate := metadata.Bitrate
+		if metadata.Video != nil && metadata.Video.Bitrate > 0 {
+			bitrate = metadata.Video.Bitrate
+		}
+		if bitrate <= 0 {
+			return nil, nil, fmt.Errorf("trial encode at crf %d has no bitrate", crf)
+		}
+		trials[i] = models.TrialEncode{CRF: crf, Bitrate: bitrate}
+	}
+
+	curve := fitBitrateCurve(trials)
+	fps := source.FPS
+	if fps <= 0 {
+		fps = 30
+	}
+	trialPixels := float64(trial.Width * trial.Height)
+	analysis := &models.LadderAnalysis{
+		MediaID:     videoID,
+		TrialWidth:  trial.Width,
+		TrialHeight: trial.Height,
+		Complexity:  curve(referenceCRF) / (trialPixels * fps),
+		Trials:      trials,
+		AnalyzedAt:  time.Now(),
+	}
+
+	adjusted := make([]models.Rendition, len(renditions))
+	for i, r := range renditions {
+		mode := rateControl(r)
+		crf := referenceCRF
+		if mode != models.RateControlTwoPass {
+			crf = r.CRF
+		}
+		predicted := curve(crf) * math.Pow(float64(r.Width*r.Height)/trialPixels, pixelExponent)
+		if r.VideoCodec == "libx265" {
+			predicted *= x265BitrateFactor
+		}
+
+		rung := models.LadderRung{
+			Rendition:   r.Name,
+			Width:       r.Width,
+			Height:      r.Height,
+			RateControl: mode,
+			Predicted:   int64(predicted),
+		}
+		r, rung.Configured, rung.Chosen = applyLadderBitrate(r, predicted)
+		adjusted[i] = r
+		analysis.Rungs = append(analysis.Rungs, rung)
+	}
+	return adjusted, analysis, nil
+}
+
+// applyLadderBitrate 按预测的平均码率调整清晰度，返回调整后的清晰度、配置的码率和选择的码率
+// crf 模式调整 maxrate 和 bufsize，2pass 模式调整 bitrate 并按比例调整 maxrate 和 bufsize
+func applyLadderBitrate(r models.Rendition, predicted float64) (models.Rendition, int64, int64) {
+	switch rateControl(r) {
+	case models.RateControlCRF:
+		maxRate, _ := rateCaps(r)
+		configured, err := ParseBitrate(maxRate)
+		if err != nil {
+			return r, 0, 0
+		}
+		chosen := clampLadderBitrate(predicted*crfCapHeadroom, configured)
+		r.MaxRate = formatBitrate(chosen)
+		r.BufSize = formatBitrate(chosen * 2)
+		return r, configured, chosen
+	case models.RateControlTwoPass:
+		configured, err := ParseBitrate(r.Bitrate)
+		if err != nil {
+			return r, 0, 0
+		}
+		chosen := clampLadderBitrate(predicted, configured)
+		r.Bitrate = formatBitrate(chosen)
+		scale := float64(chosen) / float64(configured)
+		if maxRate, err := ParseBitrate(r.MaxRate); err == nil {
+			r.MaxRate = formatBitrate(int64(float64(maxRate) * scale))
+		}
+		if bufSize, err := ParseBitrate(r.BufSize); err == nil {
+			r.BufSize = formatBitrate(int64(float64(bufSize) * scale))
+		}
+		return r, configured, chosen
+	}
+	// cq 模式不限制码率，只记录预测值
+	return r, 0, 0
+}
+
+// clampLadderBitrate 把码率限制在配置码率的 minLadderScale 到 maxLadderScale 倍之间，取整到 kbit/s
+// 拟合失败得到 NaN 时使用配置的码率
+func clampLadderBitrate(bitrate float64, configured int64) int64 {
+	if math.IsNaN(bitrate) {
+		bitrate = float64(configured)
+	}
+	bitrate = math.Max(bitrate, float64(configured)*minLadderScale)
+	bitrate = math.Min(bitrate, float64(configured)*maxLadderScale)
+	return int64(math.Round(bitrate/1000)) * 1000
+}
+
+// formatBitrate 把 bit/s 格式化为 ffmpeg 接受的 "2500k"
+func formatBitrate(bitrate int64) string {
+	return fmt.Sprintf("%dk", max(bitrate/1000, 1))
+}
+
+// fitBitrateCurve 用最小二乘法拟合 log(码率) = a + b*CRF，返回任意 CRF 下的估计码率
+// CRF 每增加 6 码率大约减半，对数和 CRF 近似为线性关系
+func fitBitrateCurve(trials []models.TrialEncode) func(crf int) float64 {
+	var n, sumX, sumY, sumXX, sumXY float64
+	for _, t := range trials {
+		x, y := float64(t.CRF), math.Log(float64(t.Bitrate))
+		n++
+		sumX += x
+		sumY += y
+		sumXX += x * x
+		sumXY += x * y
+	}
+	var slope float64
+	if d := n*sumXX - sumX*sumX; d != 0 {
+		slope = (n*sumXY - sumX*sumY) / d
+	}
+	intercept := (sumY - slope*sumX) / n
+	return func(crf int) float64 {
+		return math.Exp(intercept + slope*float64(crf))
+	}
+}
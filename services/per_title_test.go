@@ -0,0 +1,220 @@
+package services
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"testing"
+	"video-streaming/models"
+)
+
+func TestSampleRanges(t *testing.T) {
+	tests := []struct {
+		duration float64
+		count    int
+		length   float64
+		want     [][2]float64
+	}{
+		// 足够长时每段位于均分后区间的中间
+		{30, 3, 4, [][2]float64{{3, 4}, {13, 4}, {23, 4}}},
+		{100, 5, 1.5, [][2]float64{{9.25, 1.5}, {29.25, 1.5}, {49.25, 1.5}, {69.25, 1.5}, {89.25, 1.5}}},
+		// 不到总长度两倍时只取开头
+		{20, 3, 4, [][2]float64{{0, 12}}},
+		{5, 3, 4, [][2]float64{{0, 5}}},
+	}
+	for _, tt := range tests {
+		if got := sampleRanges(tt.duration, tt.count, tt.length); !slices.Equal(got, tt.want) {
+			t.Errorf("sampleRanges(%v, %d, %v) = %v, want %v", tt.duration, tt.count, tt.length, got, tt.want)
+		}
+	}
+}
+
+func TestFitBitrateCurve(t *testing.T) {
+	tests := []struct {
+		name   string
+		trials []models.TrialEncode
+		crf    int
+		want   float64
+	}{
+		// CRF 每增加 6 码率减半
+		{"exact", []models.TrialEncode{{CRF: 20, Bitrate: 4000000}, {CRF: 26, Bitrate: 2000000}, {CRF: 32, Bitrate: 1000000}}, 23, 4000000 / math.Sqrt2},
+		{"extrapolate", []models.TrialEncode{{CRF: 20, Bitrate: 4000000}, {CRF: 26, Bitrate: 2000000}, {CRF: 32, Bitrate: 1000000}}, 38, 500000},
+		// 码率不随 CRF 变化时得到水平的曲线
+		{"flat", []models.TrialEncode{{CRF: 20, Bitrate: 2000000}, {CRF: 26, Bitrate: 2000000}, {CRF: 32, Bitrate: 2000000}}, 40, 2000000},
+		// 无法求斜率时取码率的几何平均
+		{"single trial", []models.TrialEncode{{CRF: 23, Bitrate: 1000000}}, 30, 1000000},
+		{"same crf", []models.TrialEncode{{CRF: 23, Bitrate: 1000000}, {CRF: 23, Bitrate: 4000000}}, 18, 2000000},
+	}
+	for _, tt := range tests {
+		got := fitBitrateCurve(tt.trials)(tt.crf)
+		if math.Abs(got-tt.want) > tt.want*1e-9 {
+			t.Errorf("%s: curve(%d) = %v, want %v", tt.name, tt.crf, got, tt.want)
+		}
+	}
+
+	// 没有试编码结果时曲线无意义，选择码率时使用配置的码率
+	if got := fitBitrateCurve(nil)(23); !math.IsNaN(got) {
+		t.Errorf("empty curve = %v, want NaN", got)
+	}
+}
+
+func TestClampLadderBitrate(t *testing.T) {
+	tests := []struct {
+		bitrate    float64
+		configured int64
+		want       int64
+	}{
+		{1234567, 1000000, 1235000},
+		{100000, 1000000, 250000},
+		{5000000, 1000000, 1500000},
+		{math.Inf(1), 1000000, 1500000},
+		{0, 1000000, 250000},
+		{math.NaN(), 1000000, 1000000},
+	}
+	for _, tt := range tests {
+		if got := clampLadderBitrate(tt.bitrate, tt.configured); got != tt.want {
+			t.Errorf("clampLadderBitrate(%v, %d) = %d, want %d", tt.bitrate, tt.configured, got, tt.want)
+		}
+	}
+}
+
+func TestApplyLadderBitrate(t *testing.T) {
+	tests := []struct {
+		name       string
+		rendition  models.Rendition
+		predicted  float64
+		want       models.Rendition
+		configured int64
+		chosen     int64
+	}{
+		{
+			"crf maxrate",
+			models.Rendition{RateControl: models.RateControlCRF, CRF: 23, MaxRate: "4000k", BufSize: "8000k"},
+			2000000,
+			models.Rendition{RateControl: models.RateControlCRF, CRF: 23, MaxRate: "3000k", BufSize: "6000k"},
+			4000000, 3000000,
+		},
+		{
+			// 没有 maxrate 时以 bitrate 为上限
+			"crf bitrate",
+			models.Rendition{RateControl: models.RateControlCRF, CRF: 23, Bitrate: "2000k"},
+			1000000,
+			models.Rendition{RateControl: models.RateControlCRF, CRF: 23, Bitrate: "2000k", MaxRate: "1500k", BufSize: "3000k"},
+			2000000, 1500000,
+		},
+		{
+			"crf clamped low",
+			models.Rendition{RateControl: models.RateControlCRF, CRF: 23, MaxRate: "4000k", BufSize: "8000k"},
+			100000,
+			models.Rendition{RateControl: models.RateControlCRF, CRF: 23, MaxRate: "1000k", BufSize: "2000k"},
+			4000000, 1000000,
+		},
+		{
+			"crf uncapped",
+			models.Rendition{RateControl: models.RateControlCRF, CRF: 23},
+			1000000,
+			models.Rendition{RateControl: models.RateControlCRF, CRF: 23},
+			0, 0,
+		},
+		{
+			// maxrate 和 bufsize 随 bitrate 按比例调整
+			"2pass",
+			models.Rendition{RateControl: models.RateControlTwoPass, Bitrate: "2000k", MaxRate: "3000k", BufSize: "4000k"},
+			1000000,
+			models.Rendition{RateControl: models.RateControlTwoPass, Bitrate: "1000k", MaxRate: "1500k", BufSize: "2000k"},
+			2000000, 1000000,
+		},
+		{
+			"2pass clamped high",
+			models.Rendition{RateControl: models.RateControlTwoPass, Bitrate: "2000k", MaxRate: "3000k", BufSize: "4000k"},
+			10000000,
+			models.Rendition{RateControl: models.RateControlTwoPass, Bitrate: "3000k", MaxRate: "4500k", BufSize: "6000k"},
+			2000000, 3000000,
+		},
+		{
+			"2pass degenerate curve",
+			models.Rendition{RateControl: models.RateControlTwoPass, Bitrate: "2000k"},
+			math.NaN(),
+			models.Rendition{RateControl: models.RateControlTwoPass, Bitrate: "2000k"},
+			2000000, 2000000,
+		},
+		{
+			"cq",
+			models.Rendition{RateControl: models.RateControlCQ, CRF: 23, MaxRate: "2000k"},
+			1000000,
+			models.Rendition{RateControl: models.RateControlCQ, CRF: 23, MaxRate: "2000k"},
+			0, 0,
+		},
+	}
+	for _, tt := range tests {
+		got, configured, chosen := applyLadderBitrate(tt.rendition, tt.predicted)
+		if got != tt.want || configured != tt.configured || chosen != tt.chosen {
+			t.Errorf("%s: got %+v, configured %d, chosen %d\nwant %+v, configured %d, chosen %d",
+				tt.name, got, configured, chosen, tt.want, tt.configured, tt.chosen)
+		}
+	}
+}
+
+// ladderRenditions 是和默认配置相同的阶梯
+var ladderRenditions = []models.Rendition{
+	{Name: "1080p", Width: 1920, Height: 1080, VideoCodec: "libx264", RateControl: models.RateControlCRF, CRF: 23, MaxRate: "4000k", BufSize: "8000k"},
+	{Name: "720p", Width: 1280, Height: 720, VideoCodec: "libx264", RateControl: models.RateControlCRF, CRF: 23, MaxRate: "2500k", BufSize: "5000k"},
+	{Name: "480p", Width: 854, Height: 480, VideoCodec: "libx264", RateControl: models.RateControlCRF, CRF: 23, MaxRate: "1000k", BufSize: "2000k"},
+}
+
+func TestAnalyzeLadder(t *testing.T) {
+	useFake(t, NewFakeFFmpeg())
+	s := NewTranscodeService(t.TempDir(), nil)
+	source := &SourceInfo{Width: 1920, Height: 1080, SARNum: 1, SARDen: 1, FPS: 30}
+
+	adjusted, analysis, err := s.analyzeLadder("source.mp4", "video", source, 60, fitRenditions(source, ladderRenditions))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if analysis.TrialWidth != 960 || analysis.TrialHeight != 540 || len(analysis.Trials) != len(trialCRFs) {
+		t.Fatalf("analysis = %+v", analysis)
+	}
+	// fake 的每次试编码码率都是 2000000，曲线是水平的，预测码率只随像素数增长，都超过上限
+	if want := 2000000 / (960 * 540 * 30.0); math.Abs(analysis.Complexity-want) > 1e-12 {
+		t.Errorf("complexity = %v, want %v", analysis.Complexity, want)
+	}
+	wantMaxRates := []string{"6000k", "3750k", "1500k"}
+	wantChosen := []int64{6000000, 3750000, 1500000}
+	for i, r := range adjusted {
+		if r.MaxRate != wantMaxRates[i] {
+			t.Errorf("%s maxrate = %s, want %s", r.Name, r.MaxRate, wantMaxRates[i])
+		}
+		if rung := analysis.Rungs[i]; rung.Predicted <= 0 || rung.Chosen != wantChosen[i] {
+			t.Errorf("%s rung = %+v, want chosen %d", r.Name, rung, wantChosen[i])
+		}
+	}
+}
+
+func TestAnalyzeLadderFailures(t *testing.T) {
+	noBitrate := NewFakeFFmpeg()
+	noBitrate.Result.Streams[0].BitRate = ""
+	noBitrate.Result.Format.BitRate = ""
+	failing := NewFakeFFmpeg()
+	failing.RunErr = errors.New("encoder crashed")
+
+	tests := []struct {
+		name     string
+		fake     *FakeFFmpeg
+		duration float64
+	}{
+		{"unknown duration", NewFakeFFmpeg(), 0},
+		{"all trials failing", failing, 60},
+		{"trials without bitrate", noBitrate, 60},
+	}
+	source := &SourceInfo{Width: 1920, Height: 1080, SARNum: 1, SARDen: 1, FPS: 30}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFake(t, tt.fake)
+			s := NewTranscodeService(t.TempDir(), nil)
+			adjusted, analysis, err := s.analyzeLadder("source.mp4", "video", source, tt.duration, fitRenditions(source, ladderRenditions))
+			if err == nil {
+				t.Fatalf("analysis succeeded: %+v %+v", adjusted, analysis)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"video-streaming/models"
+	"video-streaming/storage"
+)
+
+// Pipeline 串联上传完成后的各个处理阶段
+// 转码和打包在本地工作目录中进行，全部完成后再写入存储
+type Pipeline struct {
+	Transcoder *TranscodeService
+	Packager   *PlaylistService
+	Thumbnails *ThumbnailService
+	Storage    storage.Storage
+}
+
+func NewPipeline(transcoder *TranscodeService, packager *PlaylistService, thumbnails *ThumbnailService, store storage.Storage) *Pipeline {
+	return &Pipeline{
+		Transcoder: transcoder,
+		Packager:   packager,
+		Thumbnails: thumbnails,
+		Storage:    store,
+	}
+}
+
+// ProcessJob 是转码任务的处理函数，负责更新视频状态
+// 任务的视频 ID 即媒体 ID，复用该媒体的视频状态一起更新
+func (p *Pipeline) ProcessJob(job *models.Job) error {
+	// 清理上次中断留下的中间文件
+	workDir := filepath.Join(p.Transcoder.BaseDir, job.VideoID)
+	if err := os.RemoveAll(workDir); err != nil {
+		return fmt.Errorf("failed to clean work directory: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(workDir); err != nil {
+			log.Printf("Failed to remove work directory %s: %v", workDir, err)
+		}
+	}()
+
+	renditions, err := p.Transcoder.TranscodeVideo(job.VideoID)
+	if err != nil {
+		models.UpdateMediaStatus(job.VideoID, "error")
+		return fmt.Errorf("transcoding failed: %v", err)
+	}
+
+	// 把转码结果打包为 HLS / DASH
+	if err := p.Packager.Package(job.VideoID, renditions, p.Transcoder.Packaging); err != nil {
+		models.UpdateMediaStatus(job.VideoID, "error")
+		return fmt.Errorf("packaging failed: %v", err)
+	}
+
+	// 缩略图和预览不影响播放，生成失败时只记录日志
+	if err := p.Thumbnails.Generate(job.VideoID, renditions); err != nil {
+		log.Printf("Failed to generate thumbnails for %s: %v", job.VideoID, err)
+	}
+	preview, err := p.Thumbnails.GeneratePreview(job.VideoID, renditions)
+	if err != nil {
+		log.Printf("Failed to generate preview for %s: %v", job.VideoID, err)
+	}
+
+	if err := p.store(job.VideoID, workDir); err != nil {
+		models.UpdateMediaStatus(job.VideoID, "error")
+		return fmt.Errorf("failed to store outputs: %v", err)
+	}
+	// 预览写入存储后才记录，视频 JSON 根据这条记录返回预览地址
+	if preview != nil {
+		if err := models.SaveMetadata(job.VideoID, models.MetadataPreview, preview); err != nil {
+			log.Printf("Failed to save preview metadata for %s: %v", job.VideoID, err)
+		}
+	}
+
+	if err := models.UpdateMediaStatus(job.VideoID, "ready"); err != nil {
+		return fmt.Errorf("failed to update video status: %v", err)
+	}
+	return nil
+}
+
+// store 删除旧的打包结果和缩略图后把工作目录写入存储
+func (p *Pipeline) store(videoID, workDir string) error {
+	ctx := context.Background()
+	for _, dir := range []string{"hls", "cmaf", ThumbnailDir} {
+		if err := storage.DeleteAll(ctx, p.Storage, videoID+"/"+dir+"/"); err != nil {
+			return err
+		}
+	}
+	return storage.PutDir(ctx, p.Storage, workDir, videoID)
+}
@@ -0,0 +1,280 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+	"video-streaming/models"
+	"video-streaming/storage"
+)
+
+// pipelineEnv 是测试共用的数据库、存储和任务队列
+// 任务队列的工作协程无法停止，整个测试进程只启动一次，各个测试的视频 ID 不同
+type pipelineEnv struct {
+	dir       string
+	uploads   *UploadService
+	transcode *TranscodeService
+}
+
+var (
+	envOnce sync.Once
+	env     *pipelineEnv
+	envErr  error
+)
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	// 工作协程仍在轮询数据库，只删除文件
+	if env != nil {
+		os.RemoveAll(env.dir)
+	}
+	os.Exit(code)
+}
+
+// testPipeline 返回和 main 相同方式组装的上传服务，转码时计算画质分数
+func testPipeline(t *testing.T) *pipelineEnv {
+	t.Helper()
+	envOnce.Do(func() {
+		dir, err := os.MkdirTemp("", "pipeline-test-")
+		if err != nil {
+			envErr = err
+			return
+		}
+		env = &pipelineEnv{dir: dir}
+		if envErr = models.InitDB(filepath.Join(dir, "videos.db")); envErr != nil {
+			return
+		}
+		store, err := storage.NewLocal(filepath.Join(dir, "videos"))
+		if err != nil {
+			envErr = err
+			return
+		}
+
+		workDir := filepath.Join(dir, "work")
+		env.transcode = NewTranscodeService(workDir, store)
+		env.transcode.QualityMetrics = true
+		pipeline := NewPipeline(env.transcode, NewPlaylistService(workDir), NewThumbnailService(workDir), store)
+		queue := NewJobQueue()
+		queue.PollInterval = 50 * time.Millisecond
+		env.uploads = NewUploadService(filepath.Join(dir, "temp"), store, queue)
+		queue.Register(models.JobTypeAssemble, 1, env.uploads.AssembleJob)
+		queue.Register(models.JobTypeTranscode, 1, pipeline.ProcessJob)
+		envErr = queue.Start()
+	})
+	if envErr != nil {
+		t.Fatalf("failed to set up pipeline: %v", envErr)
+	}
+	return env
+}
+
+// useFake 把 MediaProber 和 MediaEncoder 替换为 fake，测试结束后恢复
+func useFake(t *testing.T, fake *FakeFFmpeg) {
+	t.Helper()
+	prober, encoder := MediaProber, MediaEncoder
+	MediaProber, MediaEncoder = fake, fake
+	// libvmaf 的检测结果取决于当前的 Encoder，每个测试重新检测
+	vmafOnce = sync.Once{}
+	t.Cleanup(func() {
+		MediaProber, MediaEncoder = prober, encoder
+		vmafOnce = sync.Once{}
+	})
+}
+
+// uploadVideo 和上传接口一样创建视频和会话，写入全部数据后提交合并，返回视频 ID
+// 分片上传写入唯一的分片，tus 上传写入数据文件。文件内容包含视频 ID，不会和之前的上传去重
+func uploadVideo(t *testing.T, e *pipelineEnv, protocol string) string {
+	t.Helper()
+	now := time.Now()
+	id := fmt.Sprintf("video-%d", now.UnixNano())
+	content := "fake video " + id
+	video := &models.Video{
+		ID:          id,
+		Title:       t.Name(),
+		FileName:    "clip.mp4",
+		FileSize:    int64(len(content)),
+		ContentType: "video/mp4",
+		Status:      "pending",
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if err := video.Save(); err != nil {
+		t.Fatalf("failed to save video: %v", err)
+	}
+	session := &models.UploadSession{
+		ID:        video.ID,
+		VideoID:   video.ID,
+		Protocol:  protocol,
+		FileName:  video.FileName,
+		FileSize:  video.FileSize,
+		Mode:      models.UploadModeProxy,
+		Owner:     "test",
+		State:     models.UploadStateActive,
+		CreatedAt: now,
+		UpdatedAt: now,
+		ExpiresAt: now.Add(UploadSessionTTL),
+	}
+	dataFile := TusDataFile
+	if protocol == models.UploadProtocolChunked {
+		session.ChunkSize, session.ChunkCount = video.FileSize, 1
+		dataFile = "chunk_0"
+	}
+	if err := models.CreateUploadSession(session); err != nil {
+		t.Fatalf("failed to create upload session: %v", err)
+	}
+
+	chunkDir := filepath.Join(e.uploads.BaseDir, session.ID)
+	if err := os.MkdirAll(chunkDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(chunkDir, dataFile), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.uploads.StartAssembly(session); err != nil {
+		t.Fatalf("failed to start assembly: %v", err)
+	}
+	return video.ID
+}
+
+// waitForStatus 等待视频离开 pending 和 processing 状态，返回最终的视频
+func waitForStatus(t *testing.T, videoID string) *models.Video {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		video, err := models.GetVideoByID(videoID)
+		if err != nil {
+			t.Fatalf("failed to get video: %v", err)
+		}
+		if video.Status != "pending" && video.Status != "processing" {
+			return video
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("video %s is still processing", videoID)
+	return nil
+}
+
+// transcodeJob 返回视频的转码任务
+func transcodeJob(t *testing.T, videoID string) *models.Job {
+	t.Helper()
+	jobs, err := models.GetJobsByVideoID(videoID)
+	if err != nil {
+		t.Fatalf("failed to get jobs: %v", err)
+	}
+	for _, job := range jobs {
+		if job.Type == models.JobTypeTranscode {
+			return job
+		}
+	}
+	t.Fatalf("video %s has no transcode job", videoID)
+	return nil
+}
+
+func TestPipelineUploadReady(t *testing.T) {
+	e := testPipeline(t)
+	fake := NewFakeFFmpeg()
+	useFake(t, fake)
+
+	videoID := uploadVideo(t, e, models.UploadProtocolChunked)
+	video := waitForStatus(t, videoID)
+	if video.Status != "ready" {
+		t.Fatalf("status = %s, want ready: %s", video.Status, transcodeJob(t, videoID).Error)
+	}
+
+	// 默认配置的三个清晰度都不高于 1920x1080 的源视频，480p 按源视频的宽高比取偶数宽度
+	want := map[string][2]int{"1080p": {1920, 1080}, "720p": {1280, 720}, "480p": {852, 480}}
+	if len(video.Qualities) != len(want) {
+		t.Fatalf("got %d qualities, want %d", len(video.Qualities), len(want))
+	}
+	for _, q := range video.Qualities {
+		size, ok := want[q.Resolution]
+		if !ok {
+			t.Errorf("unexpected quality %s", q.Resolution)
+			continue
+		}
+		if q.Width != size[0] || q.Height != size[1] {
+			t.Errorf("%s is %dx%d, want %dx%d", q.Resolution, q.Width, q.Height, size[0], size[1])
+		}
+		if q.Size <= 0 {
+			t.Errorf("%s has size %d", q.Resolution, q.Size)
+		}
+		if q.Scores == nil || q.Scores.VMAF == nil || q.Scores.SSIM == nil || q.Scores.PSNR == nil {
+			t.Errorf("%s has incomplete scores %+v", q.Resolution, q.Scores)
+			continue
+		}
+		if *q.Scores.VMAF != 90 || q.Scores.BelowThreshold {
+			t.Errorf("%s scores = %s, below threshold %v", q.Resolution, formatScores(q.Scores), q.Scores.BelowThreshold)
+		}
+	}
+
+	for _, key := range []string{"original.mp4", "1080p.mp4", "hls/master.m3u8", "cmaf/manifest.mpd"} {
+		if _, err := e.transcode.Storage.Stat(t.Context(), videoID+"/"+key); err != nil {
+			t.Errorf("%s not stored: %v", key, err)
+		}
+	}
+}
+
+func TestPipelineTusUpload(t *testing.T) {
+	e := testPipeline(t)
+	useFake(t, NewFakeFFmpeg())
+
+	videoID := uploadVideo(t, e, models.UploadProtocolTus)
+	video := waitForStatus(t, videoID)
+	if video.Status != "ready" {
+		t.Fatalf("status = %s, want ready: %s", video.Status, transcodeJob(t, videoID).Error)
+	}
+	session, err := models.GetUploadSession(videoID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.State != models.UploadStateCompleted {
+		t.Errorf("session is %s, want completed", session.State)
+	}
+	// 合并任务开始转码后才删除数据文件，可能晚于转码完成
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		_, err := os.Stat(filepath.Join(e.uploads.BaseDir, videoID))
+		if os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("upload directory not removed: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestPipelineEncoderFailure(t *testing.T) {
+	e := testPipeline(t)
+	fake := NewFakeFFmpeg()
+	fake.RunErr = errors.New("encoder crashed")
+	useFake(t, fake)
+
+	videoID := uploadVideo(t, e, models.UploadProtocolChunked)
+	video := waitForStatus(t, videoID)
+	if video.Status != "error" {
+		t.Fatalf("status = %s, want error", video.Status)
+	}
+	if len(video.Qualities) != 0 {
+		t.Errorf("got %d qualities, want none", len(video.Qualities))
+	}
+
+	// 视频状态先于任务状态更新
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		job := transcodeJob(t, videoID)
+		if job.Status == models.JobStatusFailed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("transcode job is %s, want failed", job.Status)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if len(fake.Calls()) == 0 {
+		t.Error("encoder was never called")
+	}
+}
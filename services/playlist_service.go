@@ -2,11 +2,34 @@ package services
 
 import (
 	"fmt"
+	"math"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"video-streaming/models"
 )
 
+// PackagingFormat 决定转码后生成哪些流媒体格式
+type PackagingFormat string
+
+const (
+	// PackagingHLS 只生成 MPEG-TS 切片的 HLS
+	PackagingHLS PackagingFormat = "hls"
+	// PackagingCMAF 生成 fMP4 切片，DASH 和 HLS 共用同一份切片
+	PackagingCMAF PackagingFormat = "cmaf"
+	// PackagingAll 同时生成 MPEG-TS HLS 和 CMAF
+	PackagingAll PackagingFormat = "all"
+)
+
+func ParsePackagingFormat(s string) (PackagingFormat, error) {
+	switch f := PackagingFormat(strings.ToLower(strings.TrimSpace(s))); f {
+	case PackagingHLS, PackagingCMAF, PackagingAll:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown packaging format %q", s)
+}
+
 type PlaylistService struct {
 	BaseDir string
 }
@@ -17,57 +40,75 @@ func NewPlaylistService(baseDir string) *PlaylistService {
 	}
 }
 
-func (s *PlaylistService) GenerateHLSPlaylist(videoID string) error {
-	videoPath := filepath.Join(s.BaseDir, videoID, "original.mp4")
-	outputDir := filepath.Join(s.BaseDir, videoID, "hls")
+// Package 按照打包格式生成对应的清单和切片
+func (s *PlaylistService) Package(videoID string, qualities []models.Rendition, format PackagingFormat) error {
+	if format == PackagingHLS || format == PackagingAll {
+		if err := s.GenerateHLSPlaylist(videoID, qualities); err != nil {
+			return err
+		}
+	}
+	if format == PackagingCMAF || format == PackagingAll {
+		if err := s.GenerateCMAF(videoID, qualities); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GenerateHLSPlaylist 把已转码的各清晰度 MP4 切片为 HLS，并生成主播放列表
+func (s *PlaylistService) GenerateHLSPlaylist(videoID string, qualities []models.Rendition) error {
+	videoDir := filepath.Join(s.BaseDir, videoID)
+	outputDir := filepath.Join(videoDir, "hls")
 
-	// 创建输出目录
+	// 重新生成时清理旧的切片
+	if err := os.RemoveAll(outputDir); err != nil {
+		return fmt.Errorf("failed to clean output directory: %v", err)
+	}
 	if err := os.MkdirAll(outputDir, 0755); err != nil {
 		return fmt.Errorf("failed to create output directory: %v", err)
 	}
 
-	// 生成不同质量的HLS流
-	qualities := []struct {
-		name       string
-		resolution string
-		bitrate    string
-	}{
-		{"1080p", "1920x1080", "4000k"},
-		{"720p", "1280x720", "2500k"},
-		{"480p", "854x480", "1000k"},
-	}
-
 	// 生成主播放列表
 	masterPlaylist := "#EXTM3U\n"
 	masterPlaylist += "#EXT-X-VERSION:3\n"
 
 	for _, quality := range qualities {
-		// 为每个质量生成单独的播放列表
-		playlistPath := filepath.Join(outputDir, quality.name+".m3u8")
-		segmentPath := filepath.Join(outputDir, quality.name)
-
-		// 使用FFmpeg生成HLS流
-		cmd := exec.Command("ffmpeg",
-			"-i", videoPath,
-			"-c:v", "libx264",
-			"-c:a", "aac",
-			"-b:v", quality.bitrate,
-			"-s", quality.resolution,
+		inputPath := filepath.Join(videoDir, quality.Name+".mp4")
+		playlistPath := filepath.Join(outputDir, quality.Name+".m3u8")
+		segmentDir := filepath.Join(outputDir, quality.Name)
+
+		if err := os.MkdirAll(segmentDir, 0755); err != nil {
+			return fmt.Errorf("failed to create segment directory: %v", err)
+		}
+
+		// 转码结果已是 H.264/AAC，直接复制流切片
+		args := []string{
+			"-i", inputPath,
+			"-c", "copy",
 			"-f", "hls",
-			"-hls_time", "10",
+			"-hls_time", "6",
+			"-hls_playlist_type", "vod",
 			"-hls_list_size", "0",
-			"-hls_segment_filename", filepath.Join(segmentPath, "segment_%03d.ts"),
+			"-hls_segment_filename", filepath.Join(segmentDir, "segment_%03d.ts"),
+			"-y",
 			playlistPath,
-		)
+		}
+		if err := MediaEncoder.Run(args, nil); err != nil {
+			return fmt.Errorf("failed to generate HLS stream for %s: %v", quality.Name, err)
+		}
 
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("failed to generate HLS stream for %s: %v", quality.name, err)
+		peak, average, err := measureBandwidth(playlistPath, inputPath)
+		if err != nil {
+			return fmt.Errorf("failed to measure bitrate of %s: %v", quality.Name, err)
+		}
+		codecs, err := hlsCodecs(inputPath)
+		if err != nil {
+			return fmt.Errorf("failed to probe codecs of %s: %v", quality.Name, err)
 		}
 
-		// 添加到主播放列表
-		masterPlaylist += fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%s,RESOLUTION=%s\n",
-			quality.bitrate, quality.resolution)
-		masterPlaylist += fmt.Sprintf("%s.m3u8\n", quality.name)
+		// 添加到主播放列表，BANDWIDTH 必须是以 bit/s 为单位的整数
+		masterPlaylist += streamInf(peak, average, quality, codecs, "") + "\n"
+		masterPlaylist += fmt.Sprintf("%s.m3u8\n", quality.Name)
 	}
 
 	// 保存主播放列表
@@ -78,3 +119,265 @@ func (s *PlaylistService) GenerateHLSPlaylist(videoID string) error {
 
 	return nil
 }
+
+// measureBandwidth 按切片实际大小计算 HLS 清晰度的峰值和平均码率，单位 bit/s，包含音频和封装开销
+// HLS 规范要求 BANDWIDTH 不低于任何切片的码率，按配置的码率估算会低估复杂画面的峰值
+// 播放列表中没有可用的切片时使用整个 MP4 文件的平均码率
+func measureBandwidth(playlistPath, inputPath string) (peak, average int64, err error) {
+	peak, average, err = segmentBitrates(playlistPath)
+	if err == nil && peak > 0 {
+		return peak, average, nil
+	}
+
+	_, metadata, err := probeMedia(inputPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	if metadata.Bitrate <= 0 {
+		return 0, 0, fmt.Errorf("unknown bitrate")
+	}
+	return metadata.Bitrate, metadata.Bitrate, nil
+}
+
+// streamInf 返回主播放列表中清晰度的 #EXT-X-STREAM-INF 行，codecs 为空时省略 CODECS，audio 是音频组的 GROUP-ID
+func streamInf(peak, average int64, quality models.Rendition, codecs, audio string) string {
+	line := fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d,AVERAGE-BANDWIDTH=%d,RESOLUTION=%s", peak, average, quality.Resolution())
+	if codecs != "" {
+		line += fmt.Sprintf(",CODECS=\"%s\"", codecs)
+	}
+	if audio != "" {
+		line += fmt.Sprintf(",AUDIO=\"%s\"", audio)
+	}
+	return line
+}
+
+// hlsCodecs 按 ffprobe 读取的编码参数生成 CODECS 属性的值，如 "avc1.4d4028,mp4a.40.2"
+// 播放器据此在下载切片前判断能否播放。CODECS 必须列出所有编码，有无法识别的编码时返回空字符串
+func hlsCodecs(inputPath string) (string, error) {
+	result, err := MediaProber.Probe(inputPath)
+	if err != nil {
+		return "", err
+	}
+
+	var codecs []string
+	for _, codecType := range []string{"video", "audio"} {
+		stream := result.stream(codecType)
+		if stream == nil {
+			continue
+		}
+		codec := codecTag(stream)
+		if codec == "" {
+			return "", nil
+		}
+		codecs = append(codecs, codec)
+	}
+	return strings.Join(codecs, ","), nil
+}
+
+// H.264 各档次的 profile_idc 和 constraint_set 标志，对应 RFC 6381 中 avc1 之后的前两个字节
+var avcProfiles = map[string][2]int{
+	"Constrained Baseline": {0x42, 0xe0},
+	"Baseline":             {0x42, 0x00},
+	"Main":                 {0x4d, 0x40},
+	"High":                 {0x64, 0x00},
+	"High 10":              {0x6e, 0x00},
+}
+
+// codecTag 返回一条流在 RFC 6381 中的编码标识，只支持转码可能输出的编码，其他返回空字符串
+func codecTag(stream *ProbeStream) string {
+	switch stream.CodecName {
+	case "h264":
+		profile, ok := avcProfiles[stream.Profile]
+		if !ok || stream.Level <= 0 {
+			return ""
+		}
+		return fmt.Sprintf("avc1.%02x%02x%02x", profile[0], profile[1], stream.Level)
+	case "hevc":
+		// 转码使用 hvc1 标签，约束标志按逐行扫描的 8 位或 10 位输出填写
+		if stream.Level <= 0 {
+			return ""
+		}
+		switch stream.Profile {
+		case "Main":
+			return fmt.Sprintf("hvc1.1.6.L%d.B0", stream.Level)
+		case "Main 10":
+			return fmt.Sprintf("hvc1.2.4.L%d.B0", stream.Level)
+		}
+	case "aac":
+		switch stream.Profile {
+		case "LC":
+			return "mp4a.40.2"
+		case "HE-AAC":
+			return "mp4a.40.5"
+		case "HE-AACv2":
+			return "mp4a.40.29"
+		}
+	}
+	return ""
+}
+
+// segmentBitrates 读取媒体播放列表的 #EXTINF 时长和对应切片文件的大小
+func segmentBitrates(playlistPath string) (peak, average int64, err error) {
+	data, err := os.ReadFile(playlistPath)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var totalBytes int64
+	var totalDuration, segmentDuration float64
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if value, ok := strings.CutPrefix(line, "#EXTINF:"); ok {
+			value, _, _ = strings.Cut(value, ",")
+			segmentDuration, _ = strconv.ParseFloat(value, 64)
+			continue
+		}
+		if line == "" || strings.HasPrefix(line, "#") || segmentDuration <= 0 {
+			continue
+		}
+
+		info, err := os.Stat(filepath.Join(filepath.Dir(playlistPath), filepath.FromSlash(line)))
+		if err != nil {
+			return 0, 0, err
+		}
+		peak = max(peak, int64(math.Ceil(float64(info.Size())*8/segmentDuration)))
+		totalBytes += info.Size()
+		totalDuration += segmentDuration
+		segmentDuration = 0
+	}
+	if totalDuration > 0 {
+		average = int64(math.Ceil(float64(totalBytes) * 8 / totalDuration))
+	}
+	return peak, average, nil
+}
+
+// GenerateCMAF 把各清晰度打包为 CMAF 切片，同时生成 DASH 清单和 fMP4 HLS 播放列表
+func (s *PlaylistService) GenerateCMAF(videoID string, qualities []models.Rendition) error {
+	if len(qualities) == 0 {
+		return fmt.Errorf("no renditions to package")
+	}
+	videoDir := filepath.Join(s.BaseDir, videoID)
+	outputDir := filepath.Join(videoDir, "cmaf")
+
+	if err := os.RemoveAll(outputDir); err != nil {
+		return fmt.Errorf("failed to clean output directory: %v", err)
+	}
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %v", err)
+	}
+
+	// 每个清晰度作为一个输入，视频轨分别映射，音轨只取第一个
+	var args []string
+	for _, quality := range qualities {
+		args = append(args, "-i", filepath.Join(videoDir, quality.Name+".mp4"))
+	}
+	for i := range qualities {
+		args = append(args, "-map", fmt.Sprintf("%d:v:0", i))
+	}
+	adaptationSets := "id=0,streams=v"
+	hasAudio, err := hasAudioStream(filepath.Join(videoDir, qualities[0].Name+".mp4"))
+	if err != nil {
+		return fmt.Errorf("failed to probe audio stream: %v", err)
+	}
+	if hasAudio {
+		args = append(args, "-map", "0:a:0")
+		adaptationSets += " id=1,streams=a"
+	}
+
+	args = append(args,
+		"-c", "copy",
+		"-f", "dash",
+		"-seg_duration", "6",
+		"-use_template", "1",
+		"-use_timeline", "1",
+		"-init_seg_name", "init-$RepresentationID$.m4s",
+		"-media_seg_name", "chunk-$RepresentationID$-$Number%05d$.m4s",
+		"-adaptation_sets", adaptationSets,
+		// 同时输出引用相同切片的 HLS 播放列表
+		"-hls_playlist", "1",
+		"-hls_master_name", "master.m3u8",
+		"-y",
+		filepath.Join(outputDir, "manifest.mpd"),
+	)
+
+	if err := MediaEncoder.Run(args, nil); err != nil {
+		return fmt.Errorf("failed to generate CMAF package: %v", err)
+	}
+
+	// ffmpeg 生成的主播放列表按流的标称码率填写 BANDWIDTH，复制流时常常偏低或缺失，按实际切片重新生成
+	return writeCMAFMaster(videoDir, outputDir, qualities, hasAudio)
+}
+
+// writeCMAFMaster 生成引用 fMP4 媒体播放列表的主播放列表，覆盖 ffmpeg 生成的 master.m3u8
+// dash 封装按输出流的序号命名媒体播放列表：视频为 media_0.m3u8 起，音轨在所有视频之后
+func writeCMAFMaster(videoDir, outputDir string, qualities []models.Rendition, hasAudio bool) error {
+	master := "#EXTM3U\n"
+	master += "#EXT-X-VERSION:7\n"
+
+	audioGroup, audioPlaylist := "", ""
+	if hasAudio {
+		audioGroup = "audio"
+		audioPlaylist = filepath.Join(outputDir, fmt.Sprintf("media_%d.m3u8", len(qualities)))
+		master += fmt.Sprintf("#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"%s\",NAME=\"audio\",DEFAULT=YES,AUTOSELECT=YES,URI=\"%s\"\n",
+			audioGroup, filepath.Base(audioPlaylist))
+	}
+
+	for i, quality := range qualities {
+		inputPath := filepath.Join(videoDir, quality.Name+".mp4")
+		playlistPath := filepath.Join(outputDir, fmt.Sprintf("media_%d.m3u8", i))
+
+		peak, average, err := measureCMAFBandwidth(playlistPath, audioPlaylist, inputPath)
+		if err != nil {
+			return fmt.Errorf("failed to measure bitrate of %s: %v", quality.Name, err)
+		}
+		codecs, err := hlsCodecs(inputPath)
+		if err != nil {
+			return fmt.Errorf("failed to probe codecs of %s: %v", quality.Name, err)
+		}
+		master += streamInf(peak, average, quality, codecs, audioGroup) + "\n"
+		master += filepath.Base(playlistPath) + "\n"
+	}
+
+	if err := os.WriteFile(filepath.Join(outputDir, "master.m3u8"), []byte(master), 0644); err != nil {
+		return fmt.Errorf("failed to write master playlist: %v", err)
+	}
+	return nil
+}
+
+// measureCMAFBandwidth 计算 fMP4 清晰度的码率。音频是单独的媒体播放列表，BANDWIDTH 要包含音频，
+// 峰值直接相加，不低于任何时刻的实际码率。没有可用的切片时使用已包含音频的 MP4 文件平均码率
+func measureCMAFBandwidth(videoPlaylist, audioPlaylist, inputPath string) (peak, average int64, err error) {
+	peak, average, err = segmentBitrates(videoPlaylist)
+	if err != nil || peak == 0 {
+		return measureBandwidth(videoPlaylist, inputPath)
+	}
+	if audioPlaylist != "" {
+		audioPeak, audioAverage, err := segmentBitrates(audioPlaylist)
+		if err != nil {
+			return 0, 0, err
+		}
+		peak += audioPeak
+		average += audioAverage
+	}
+	return peak, average, nil
+}
+
+// ParseBitrate 把 "4000k"、"2.5M" 或 "800000" 这样的码率转换为 bit/s
+func ParseBitrate(bitrate string) (int64, error) {
+	s := strings.TrimSpace(bitrate)
+	multiplier := 1.0
+	switch {
+	case strings.HasSuffix(s, "k"), strings.HasSuffix(s, "K"):
+		multiplier = 1000
+		s = s[:len(s)-1]
+	case strings.HasSuffix(s, "m"), strings.HasSuffix(s, "M"):
+		multiplier = 1000 * 1000
+		s = s[:len(s)-1]
+	}
+
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("invalid bitrate %q", bitrate)
+	}
+	return int64(value * multiplier), nil
+}
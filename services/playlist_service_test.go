@@ -0,0 +1,95 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"video-streaming/models"
+)
+
+// writeMediaPlaylist 写入 fMP4 媒体播放列表和指定大小的切片，每个切片 2 秒
+func writeMediaPlaylist(t *testing.T, dir, name string, segmentSizes ...int) {
+	t.Helper()
+	playlist := "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:2\n#EXT-X-MAP:URI=\"init-" + name + ".m4s\"\n"
+	for i, size := range segmentSizes {
+		segment := fmt.Sprintf("chunk-%s-%05d.m4s", name, i+1)
+		if err := os.WriteFile(filepath.Join(dir, segment), make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		playlist += fmt.Sprintf("#EXTINF:2.000000,\n%s\n", segment)
+	}
+	playlist += "#EXT-X-ENDLIST\n"
+	if err := os.WriteFile(filepath.Join(dir, "media_"+name+".m3u8"), []byte(playlist), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteCMAFMasterUsesSegmentPeaks(t *testing.T) {
+	useFake(t, NewFakeFFmpeg())
+
+	videoDir := t.TempDir()
+	outputDir := filepath.Join(videoDir, "cmaf")
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	qualities := []models.Rendition{
+		{Name: "720p", Width: 1280, Height: 720},
+		{Name: "480p", Width: 852, Height: 480},
+	}
+	for _, q := range qualities {
+		if err := os.WriteFile(filepath.Join(videoDir, q.Name+".mp4"), []byte("fake"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 视频峰值分别为 4000000 和 1000000 bit/s，平均为 3000000 和 750000 bit/s，音频峰值为 132000 bit/s，平均为 130000 bit/s
+	writeMediaPlaylist(t, outputDir, "0", 500000, 1000000, 750000)
+	writeMediaPlaylist(t, outputDir, "1", 250000, 125000)
+	writeMediaPlaylist(t, outputDir, "2", 33000, 32000)
+
+	if err := writeCMAFMaster(videoDir, outputDir, qualities, true); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(outputDir, "master.m3u8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"#EXTM3U",
+		"#EXT-X-VERSION:7",
+		`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio",NAME="audio",DEFAULT=YES,AUTOSELECT=YES,URI="media_2.m3u8"`,
+		`#EXT-X-STREAM-INF:BANDWIDTH=4132000,AVERAGE-BANDWIDTH=3130000,RESOLUTION=1280x720,CODECS="avc1.4d4028,mp4a.40.2",AUDIO="audio"`,
+		"media_0.m3u8",
+		`#EXT-X-STREAM-INF:BANDWIDTH=1132000,AVERAGE-BANDWIDTH=880000,RESOLUTION=852x480,CODECS="avc1.4d4028,mp4a.40.2",AUDIO="audio"`,
+		"media_1.m3u8",
+	}
+	if got := strings.TrimSpace(string(data)); got != strings.Join(want, "\n") {
+		t.Fatalf("master playlist:\n%s\nwant:\n%s", got, strings.Join(want, "\n"))
+	}
+}
+
+func TestCodecTag(t *testing.T) {
+	tests := []struct {
+		stream ProbeStream
+		want   string
+	}{
+		{ProbeStream{CodecName: "h264", Profile: "Main", Level: 40}, "avc1.4d4028"},
+		{ProbeStream{CodecName: "h264", Profile: "High", Level: 41}, "avc1.640029"},
+		{ProbeStream{CodecName: "h264", Profile: "Constrained Baseline", Level: 30}, "avc1.42e01e"},
+		{ProbeStream{CodecName: "hevc", Profile: "Main", Level: 120}, "hvc1.1.6.L120.B0"},
+		{ProbeStream{CodecName: "hevc", Profile: "Main 10", Level: 150}, "hvc1.2.4.L150.B0"},
+		{ProbeStream{CodecName: "aac", Profile: "LC", Level: -99}, "mp4a.40.2"},
+		{ProbeStream{CodecName: "aac", Profile: "HE-AAC", Level: -99}, "mp4a.40.5"},
+		// 未知的档次和编码不能写入 CODECS
+		{ProbeStream{CodecName: "h264", Profile: "High 4:4:4 Predictive", Level: 40}, ""},
+		{ProbeStream{CodecName: "h264", Profile: "Main"}, ""},
+		{ProbeStream{CodecName: "vp9", Profile: "Profile 0", Level: -99}, ""},
+	}
+	for _, tt := range tests {
+		if got := codecTag(&tt.stream); got != tt.want {
+			t.Errorf("codecTag(%s %s level %d) = %q, want %q", tt.stream.CodecName, tt.stream.Profile, tt.stream.Level, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"video-streaming/models"
+	"video-streaming/storage"
+)
+
+// ErrInvalidImage 表示上传的封面不是可以解码的 JPEG 或 PNG
+var ErrInvalidImage = errors.New("image must be a JPEG or PNG")
+
+// 上传的封面图片允许的编码，ffprobe 把图片识别为单帧的视频流
+var posterCodecs = []string{"mjpeg", "png"}
+
+// PosterService 设置视频的封面，生成各个尺寸后写入存储
+type PosterService struct {
+	BaseDir string
+	Storage storage.Storage
+}
+
+func NewPosterService(baseDir string, store storage.Storage) *PosterService {
+	return &PosterService{
+		BaseDir: baseDir,
+		Storage: store,
+	}
+}
+
+// SetFromFrame 从视频分辨率最高的清晰度截取 timestamp 秒处的一帧作为封面
+func (s *PosterService) SetFromFrame(ctx context.Context, video *models.Video, timestamp float64) error {
+	if len(video.Qualities) == 0 {
+		return fmt.Errorf("video has no renditions")
+	}
+	largest := video.Qualities[0]
+	for _, q := range video.Qualities[1:] {
+		if q.Width*q.Height > largest.Width*largest.Height {
+			largest = q
+		}
+	}
+
+	location, err := storage.Locate(ctx, s.Storage, video.StorageID()+"/"+largest.Resolution+".mp4")
+	if err != nil {
+		return fmt.Errorf("failed to locate %s: %v", largest.Resolution, err)
+	}
+
+	workDir, err := os.MkdirTemp(s.BaseDir, "poster-")
+	if err != nil {
+		return fmt.Errorf("failed to create work directory: %v", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	// -ss 放在输入前快速定位，ffmpeg 会解码到准确的时间点
+	framePath := filepath.Join(workDir, "frame.jpg")
+	args := []string{
+		"-ss", fmt.Sprintf("%.3f", timestamp),
+		"-i", location,
+		"-frames:v", "1",
+		"-an",
+		"-q:v", "2",
+		"-y",
+		framePath,
+	}
+	if err := MediaEncoder.Run(args, nil); err != nil {
+		return fmt.Errorf("failed to extract frame: %v", err)
+	}
+	// 时间点超出视频长度时 ffmpeg 正常退出但不输出图片
+	if info, err := os.Stat(framePath); err != nil || info.Size() == 0 {
+		return fmt.Errorf("no frame at %.3fs", timestamp)
+	}
+
+	return s.publish(ctx, video.ID, framePath, workDir, models.PosterSourceFrame, timestamp)
+}
+
+// SetFromImage 把上传的图片作为封面，imagePath 由调用方删除
+func (s *PosterService) SetFromImage(ctx context.Context, video *models.Video, imagePath string) error {
+	_, metadata, err := probeMedia(imagePath)
+	if err != nil || metadata.Video == nil || !slices.Contains(posterCodecs, metadata.Video.Codec) {
+		return ErrInvalidImage
+	}
+
+	workDir, err := os.MkdirTemp(s.BaseDir, "poster-")
+	if err != nil {
+		return fmt.Errorf("failed to create work directory: %v", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	return s.publish(ctx, video.ID, imagePath, workDir, models.PosterSourceUpload, 0)
+}
+
+// publish 生成封面的各个尺寸并写入存储，全部写入后才更新数据库中的封面记录
+func (s *PosterService) publish(ctx context.Context, videoID, imagePath, workDir, source string, timestamp float64) error {
+	for _, variant := range models.PosterVariants {
+		outputPath := filepath.Join(workDir, variant.Name+".jpg")
+		// 缩放到正方形外框内，较小的图片保持原尺寸
+		scale := fmt.Sprintf("scale='min(%d,iw)':'min(%d,ih)':force_original_aspect_ratio=decrease", variant.MaxSize, variant.MaxSize)
+		args := []string{
+			"-i", imagePath,
+			"-vf", scale,
+			"-frames:v", "1",
+			"-q:v", "3",
+			"-y",
+			outputPath,
+		}
+		if err := MediaEncoder.Run(args, nil); err != nil {
+			return fmt.Errorf("failed to resize poster to %s: %v", variant.Name, err)
+		}
+		if err := storage.PutFile(ctx, s.Storage, models.PosterKey(videoID, variant.Name), outputPath); err != nil {
+			return fmt.Errorf("failed to store poster %s: %v", variant.Name, err)
+		}
+	}
+
+	if err := models.SetPoster(videoID, source, timestamp); err != nil {
+		return fmt.Errorf("failed to record poster: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"video-streaming/models"
+)
+
+const (
+	// PreviewFile 是缩略图目录中的悬停预览
+	PreviewFile = "preview.mp4"
+
+	// 预览由均匀分布在视频中的几段拼接而成
+	previewSegments      = 5
+	previewSegmentLength = 1.5 // 秒
+	previewMaxSize       = 320
+	previewFPS           = 15
+)
+
+// GeneratePreview 从分辨率最低的清晰度截取几段拼接成无声的低码率 MP4，返回预览文件的技术参数
+// 视频较短时只截取开头的一段
+func (s *ThumbnailService) GeneratePreview(videoID string, renditions []models.Rendition) (*models.MediaMetadata, error) {
+	if len(renditions) == 0 {
+		return nil, fmt.Errorf("no renditions to generate preview from")
+	}
+	smallest := renditions[0]
+	for _, r := range renditions[1:] {
+		if r.Width*r.Height < smallest.Width*smallest.Height {
+			smallest = r
+		}
+	}
+	inputPath := filepath.Join(s.BaseDir, videoID, smallest.Name+".mp4")
+
+	_, metadata, err := probeMedia(inputPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to probe %s: %v", smallest.Name, err)
+	}
+	if metadata.Duration <= 0 {
+		return nil, fmt.Errorf("unknown duration")
+	}
+
+	outputDir := filepath.Join(s.BaseDir, videoID, ThumbnailDir)
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create thumbnail directory: %v", err)
+	}
+	outputPath := filepath.Join(outputDir, PreviewFile)
+
+	// 每段作为一个输入，输入前的 -ss 和 -t 只解码需要的部分
+	var args []string
+	var filters, labels strings.Builder
+	segments := sampleRanges(metadata.Duration, previewSegments, previewSegmentLength)
+	for i, seg := range segments {
+		args = append(args, "-ss", fmt.Sprintf("%.3f", seg[0]), "-t", fmt.Sprintf("%.3f", seg[1]), "-i", inputPath)
+		fmt.Fprintf(&filters, "[%d:v]fps=%d,scale='min(%d,iw)':'min(%d,ih)':force_original_aspect_ratio=decrease:force_divisible_by=2,setsar=1,setpts=PTS-STARTPTS[v%d];",
+			i, previewFPS, previewMaxSize, previewMaxSize, i)
+		fmt.Fprintf(&labels, "[v%d]", i)
+	}
+	fmt.Fprintf(&filters, "%sconcat=n=%d:v=1:a=0[out]", labels.String(), len(segments))
+
+	args = append(args,
+		"-filter_complex", filters.String(),
+		"-map", "[out]",
+		"-an",
+		"-c:v", "libx264",
+		"-preset", "veryfast",
+		"-crf", "32",
+		"-maxrate", "300k",
+		"-bufsize", "600k",
+		"-pix_fmt", "yuv420p",
+		"-movflags", "+faststart",
+		"-y",
+		outputPath,
+	)
+	if err := MediaEncoder.Run(args, nil); err != nil {
+		os.Remove(outputPath)
+		return nil, fmt.Errorf("failed to generate preview: %v", err)
+	}
+
+	_, previewMetadata, err := probeMedia(outputPath)
+	if err != nil {
+		os.Remove(outputPath)
+		return nil, fmt.Errorf("preview verification failed: %v", err)
+	}
+	return previewMetadata, nil
+}
+
+// sampleRanges 从视频中均匀截取 count 段，返回各段的开始时间和长度，每段位于均分后区间的中间
+// 预览和试编码共用
+func sampleRanges(duration float64, count int, length float64) [][2]float64 {
+	total := float64(count) * length
+	// 视频不够长时分段会互相重叠，直接使用开头
+	if duration < total*2 {
+		return [][2]float64{{0, math.Min(duration, total)}}
+	}
+
+	ranges := make([][2]float64, count)
+	span := duration / float64(count)
+	for i := range ranges {
+		ranges[i] = [2]float64{float64(i)*span + (span-length)/2, length}
+	}
+	return ranges
+}
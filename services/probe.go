@@ -0,0 +1,205 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"video-streaming/models"
+)
+
+// hasAudioStream 检查文件是否包含音轨
+func hasAudioStream(filePath string) (bool, error) {
+	result, err := MediaProber.Probe(filePath)
+	if err != nil {
+		return false, err
+	}
+	return result.stream("audio") != nil, nil
+}
+
+// SourceInfo 是源视频第一条视频流的参数
+type SourceInfo struct {
+	Width          int     // 编码宽度
+	Height         int     // 编码高度
+	Rotation       int     // 顺时针旋转角度，0、90、180 或 270
+	SARNum, SARDen int     // 像素宽高比，未知时为 1:1
+	FPS            float64 // 平均帧率，无法获取时为 0
+}
+
+// DisplaySize 返回按像素宽高比和旋转校正后的显示尺寸
+func (s *SourceInfo) DisplaySize() (int, int) {
+	w, h := s.Width, s.Height
+	if s.SARNum > 0 && s.SARDen > 0 && s.SARNum != s.SARDen {
+		w = int(math.Round(float64(w) * float64(s.SARNum) / float64(s.SARDen)))
+	}
+	if s.Rotation == 90 || s.Rotation == 270 {
+		w, h = h, w
+	}
+	return w, h
+}
+
+// ProbeStream 是 ffprobe -show_streams 输出中用到的字段
+type ProbeStream struct {
+	CodecType         string `json:"codec_type"`
+	CodecName         string `json:"codec_name"`
+	Profile           string `json:"profile"`
+	Level             int    `json:"level"` // H.264 为 level*10，HEVC 为 level*30，音频为 -99
+	Width             int    `json:"width"`
+	Height            int    `json:"height"`
+	PixFmt            string `json:"pix_fmt"`
+	SampleAspectRatio string `json:"sample_aspect_ratio"`
+	AvgFrameRate      string `json:"avg_frame_rate"`
+	RFrameRate        string `json:"r_frame_rate"`
+	BitRate           string `json:"bit_rate"`
+	ColorSpace        string `json:"color_space"`
+	ColorTransfer     string `json:"color_transfer"`
+	ColorPrimaries    string `json:"color_primaries"`
+	ColorRange        string `json:"color_range"`
+	SampleRate        string `json:"sample_rate"`
+	Channels          int    `json:"channels"`
+	ChannelLayout     string `json:"channel_layout"`
+	Disposition       struct {
+		AttachedPic int `json:"attached_pic"`
+	} `json:"disposition"`
+	Tags struct {
+		Rotate string `json:"rotate"`
+	} `json:"tags"`
+	SideDataList []struct {
+		Rotation float64 `json:"rotation"`
+	} `json:"side_data_list"`
+}
+
+// ProbeFormat 是 ffprobe -show_format 输出中用到的字段，数值以字符串表示
+type ProbeFormat struct {
+	FormatName string `json:"format_name"`
+	Duration   string `json:"duration"`
+	Size       string `json:"size"`
+	BitRate    string `json:"bit_rate"`
+}
+
+// ProbeResult 是 ffprobe -show_format -show_streams -of json 的输出
+type ProbeResult struct {
+	Streams []ProbeStream `json:"streams"`
+	Format  ProbeFormat   `json:"format"`
+}
+
+// probeMedia 读取文件的技术参数和第一条视频流的参数，location 可以是文件路径或 URL
+// 文件没有可用的视频流时返回错误
+func probeMedia(location string) (*SourceInfo, *models.MediaMetadata, error) {
+	result, err := MediaProber.Probe(location)
+	if err != nil {
+		return nil, nil, err
+	}
+	stream := result.stream("video")
+	if stream == nil {
+		return nil, nil, fmt.Errorf("no video stream")
+	}
+	if stream.Width <= 0 || stream.Height <= 0 {
+		return nil, nil, fmt.Errorf("invalid video size %dx%d", stream.Width, stream.Height)
+	}
+
+	source := stream.sourceInfo()
+	return source, result.metadata(source), nil
+}
+
+// ProbeMetadata 读取文件的技术参数，文件没有可用的视频流时返回错误
+func ProbeMetadata(location string) (*models.MediaMetadata, error) {
+	_, metadata, err := probeMedia(location)
+	return metadata, err
+}
+
+// stream 返回指定类型的第一条流，跳过作为封面的图片流
+func (r *ProbeResult) stream(codecType string) *ProbeStream {
+	for i := range r.Streams {
+		if r.Streams[i].CodecType == codecType && r.Streams[i].Disposition.AttachedPic == 0 {
+			return &r.Streams[i]
+		}
+	}
+	return nil
+}
+
+func (r *ProbeResult) metadata(source *SourceInfo) *models.MediaMetadata {
+	m := &models.MediaMetadata{
+		Duration:  parseFloat(r.Format.Duration),
+		Container: r.Format.FormatName,
+		Size:      int64(parseFloat(r.Format.Size)),
+		Bitrate:   int64(parseFloat(r.Format.BitRate)),
+		ProbedAt:  time.Now(),
+	}
+	if v := r.stream("video"); v != nil {
+		m.Video = &models.VideoStreamInfo{
+			Codec:          v.CodecName,
+			Profile:        v.Profile,
+			Width:          v.Width,
+			Height:         v.Height,
+			FPS:            source.FPS,
+			Rotation:       source.Rotation,
+			Bitrate:        int64(parseFloat(v.BitRate)),
+			PixelFormat:    v.PixFmt,
+			ColorSpace:     v.ColorSpace,
+			ColorTransfer:  v.ColorTransfer,
+			ColorPrimaries: v.ColorPrimaries,
+			ColorRange:     v.ColorRange,
+		}
+	}
+	if a := r.stream("audio"); a != nil {
+		m.Audio = &models.AudioStreamInfo{
+			Codec:         a.CodecName,
+			SampleRate:    int(parseFloat(a.SampleRate)),
+			Channels:      a.Channels,
+			ChannelLayout: a.ChannelLayout,
+			Bitrate:       int64(parseFloat(a.BitRate)),
+		}
+	}
+	return m
+}
+
+// sourceInfo 计算视频流的旋转、像素宽高比和帧率
+func (stream *ProbeStream) sourceInfo() *SourceInfo {
+	info := &SourceInfo{Width: stream.Width, Height: stream.Height, SARNum: 1, SARDen: 1}
+	// 新版 ffprobe 在显示矩阵中给出逆时针角度，旧版使用 rotate 标签
+	rotation := 0.0
+	for _, sd := range stream.SideDataList {
+		if sd.Rotation != 0 {
+			rotation = -sd.Rotation
+		}
+	}
+	if rotation == 0 && stream.Tags.Rotate != "" {
+		rotation, _ = strconv.ParseFloat(stream.Tags.Rotate, 64)
+	}
+	info.Rotation = ((int(math.Round(rotation/90))*90)%360 + 360) % 360
+
+	if num, den, ok := parseRatio(stream.SampleAspectRatio, ":"); ok {
+		info.SARNum, info.SARDen = num, den
+	}
+	if num, den, ok := parseRatio(stream.AvgFrameRate, "/"); ok {
+		info.FPS = float64(num) / float64(den)
+	} else if num, den, ok := parseRatio(stream.RFrameRate, "/"); ok {
+		info.FPS = float64(num) / float64(den)
+	}
+	return info
+}
+
+// parseFloat 解析 ffprobe 以字符串输出的数值，"N/A" 或缺失时为 0
+func parseFloat(s string) float64 {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+// parseRatio 解析 "16:9" 或 "30000/1001" 形式的比例，"0:1" 和 "N/A" 视为无效
+func parseRatio(s, sep string) (int, int, bool) {
+	a, b, found := strings.Cut(s, sep)
+	if !found {
+		return 0, 0, false
+	}
+	num, err1 := strconv.Atoi(a)
+	den, err2 := strconv.Atoi(b)
+	if err1 != nil || err2 != nil || num <= 0 || den <= 0 {
+		return 0, 0, false
+	}
+	return num, den, true
+}
@@ -0,0 +1,175 @@
+package services
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 转码结束后进度信息保留的时间
+const progressRetention = 10 * time.Minute
+
+type RenditionProgress struct {
+	Rendition string    `json:"rendition"`
+	Status    string    `json:"status"`         // pending, running, done, failed
+	Pass      int       `json:"pass,omitempty"` // 两遍编码时正在运行第几遍
+	Percent   float64   `json:"percent"`        // 0-100
+	OutTime   float64   `json:"outTime"`        // 已编码的时长（秒）
+	Speed     float64   `json:"speed"`          // 编码速度，相对实时播放的倍数
+	ETA       float64   `json:"eta"`            // 预计剩余时间（秒），未知时为 -1
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type VideoProgress struct {
+	VideoID    string               `json:"videoId"`
+	Duration   float64              `json:"duration"` // 源视频时长（秒）
+	Percent    float64              `json:"percent"`  // 所有清晰度的平均进度
+	Renditions []*RenditionProgress `json:"renditions"`
+	StartedAt  time.Time            `json:"startedAt"`
+}
+
+// ProgressTracker 在内存中记录正在转码的视频的实时进度
+type ProgressTracker struct {
+	mu     sync.RWMutex
+	videos map[string]*VideoProgress
+
+	// OnUpdate 在进度变化后被调用，可为空
+	OnUpdate func(p *VideoProgress)
+}
+
+func NewProgressTracker() *ProgressTracker {
+	return &ProgressTracker{
+		videos: make(map[string]*VideoProgress),
+	}
+}
+
+// Start 开始跟踪一个视频，renditions 为将要生成的清晰度
+func (t *ProgressTracker) Start(videoID string, duration float64, renditions []string) {
+	p := &VideoProgress{
+		VideoID:   videoID,
+		Duration:  duration,
+		StartedAt: time.Now(),
+	}
+	for _, name := range renditions {
+		p.Renditions = append(p.Renditions, &RenditionProgress{
+			Rendition: name,
+			Status:    "pending",
+			ETA:       -1,
+			UpdatedAt: p.StartedAt,
+		})
+	}
+
+	t.mu.Lock()
+	t.videos[videoID] = p
+	t.mu.Unlock()
+	t.changed(videoID)
+}
+
+// Update 修改某个清晰度的进度
+func (t *ProgressTracker) Update(videoID, rendition string, fn func(r *RenditionProgress)) {
+	t.mu.Lock()
+	p, ok := t.videos[videoID]
+	if !ok {
+		t.mu.Unlock()
+		return
+	}
+	var total float64
+	for _, r := range p.Renditions {
+		if r.Rendition == rendition {
+			fn(r)
+			r.UpdatedAt = time.Now()
+		}
+		total += r.Percent
+	}
+	if len(p.Renditions) > 0 {
+		p.Percent = total / float64(len(p.Renditions))
+	}
+	t.mu.Unlock()
+	t.changed(videoID)
+}
+
+// Finish 标记跟踪结束，进度信息会在保留期后删除
+func (t *ProgressTracker) Finish(videoID string) {
+	t.mu.RLock()
+	p, ok := t.videos[videoID]
+	t.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	time.AfterFunc(progressRetention, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		// 期间可能已经重新开始转码
+		if t.videos[videoID] == p {
+			delete(t.videos, videoID)
+		}
+	})
+}
+
+// Get 返回进度的副本
+func (t *ProgressTracker) Get(videoID string) (*VideoProgress, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	p, ok := t.videos[videoID]
+	if !ok {
+		return nil, false
+	}
+	return p.copy(), true
+}
+
+func (t *ProgressTracker) changed(videoID string) {
+	if t.OnUpdate == nil {
+		return
+	}
+	if p, ok := t.Get(videoID); ok {
+		t.OnUpdate(p)
+	}
+}
+
+func (p *VideoProgress) copy() *VideoProgress {
+	c := *p
+	c.Renditions = make([]*RenditionProgress, len(p.Renditions))
+	for i, r := range p.Renditions {
+		rc := *r
+		c.Renditions[i] = &rc
+	}
+	return &c
+}
+
+// FFmpegProgress 是 ffmpeg -progress 输出的一个数据块
+type FFmpegProgress struct {
+	OutTime float64 // 秒
+	Speed   float64
+	Done    bool
+}
+
+// parseFFmpegProgress 逐块解析 -progress 输出，每遇到 progress= 行回调一次
+func parseFFmpegProgress(r io.Reader, fn func(p FFmpegProgress)) error {
+	var cur FFmpegProgress
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "out_time_us", "out_time_ms":
+			// 两个字段的单位都是微秒
+			if us, err := strconv.ParseInt(value, 10, 64); err == nil && us >= 0 {
+				cur.OutTime = float64(us) / 1e6
+			}
+		case "speed":
+			if speed, err := strconv.ParseFloat(strings.TrimSuffix(value, "x"), 64); err == nil {
+				cur.Speed = speed
+			}
+		case "progress":
+			cur.Done = value == "end"
+			fn(cur)
+		}
+	}
+	return scanner.Err()
+}
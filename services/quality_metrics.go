@@ -0,0 +1,232 @@
+package services
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"video-streaming/models"
+)
+
+// QualityThresholds 是清晰度被标记为画质过低的分数，为 0 时不检查该指标
+// 只检查计算出的最可靠的指标：VMAF，ffmpeg 不支持时为 SSIM，再次为 PSNR
+type QualityThresholds struct {
+	VMAF float64
+	SSIM float64
+	PSNR float64 // dB
+}
+
+// DefaultQualityThresholds 大致对应小屏幕上可以接受的画质
+var DefaultQualityThresholds = QualityThresholds{VMAF: 70, SSIM: 0.9, PSNR: 30}
+
+// 本机 ffmpeg 是否编译了 libvmaf，第一次计算画质时检测
+var (
+	vmafOnce      sync.Once
+	vmafAvailable bool
+)
+
+// vmafSupported 用两段很短的测试画面运行一次 libvmaf 判断是否可用
+func vmafSupported() bool {
+	vmafOnce.Do(func() {
+		args := []string{
+			"-f", "lavfi", "-i", "testsrc=size=64x64:rate=10:duration=0.2",
+			"-f", "lavfi", "-i", "testsrc=size=64x64:rate=10:duration=0.2",
+			"-lavfi", "[0:v][1:v]libvmaf",
+			"-f", "null", os.DevNull,
+		}
+		vmafAvailable = MediaEncoder.Run(args, nil) == nil
+		if !vmafAvailable {
+			log.Printf("ffmpeg has no libvmaf, quality metrics fall back to SSIM and PSNR")
+		}
+	})
+	return vmafAvailable
+}
+
+// measureQuality 把清晰度和源视频缩放到源视频的显示尺寸后逐帧比较，返回 VMAF、SSIM 和 PSNR
+// ffmpeg 不支持 libvmaf 时只计算 SSIM 和 PSNR
+func (s *TranscodeService) measureQuality(inputPath, videoID string, source *SourceInfo, quality models.Rendition) (*models.QualityScores, error) {
+	workDir, err := os.MkdirTemp(s.BaseDir, "metrics-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create work directory: %v", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	// 源视频读取时已按旋转信息转正，两边都缩放到相同的方形像素尺寸才能逐帧比较
+	srcW, srcH := source.DisplaySize()
+	scale := fmt.Sprintf("scale=%d:%d:flags=bicubic,setsar=1,setpts=PTS-STARTPTS", evenSize(float64(srcW)), evenSize(float64(srcH)))
+	withVMAF := vmafSupported()
+	metrics := 2
+	if withVMAF {
+		metrics = 3
+	}
+
+	// 比较滤镜的第一个输入是待评价的清晰度，第二个是参考的源视频
+	ssimPath := filepath.Join(workDir, "ssim.log")
+	psnrPath := filepath.Join(workDir, "psnr.log")
+	vmafPath := filepath.Join(workDir, "vmaf.json")
+	var filter strings.Builder
+	fmt.Fprintf(&filter, "[0:v]%s,split=%d", scale, metrics)
+	for i := 0; i < metrics; i++ {
+		fmt.Fprintf(&filter, "[d%d]", i)
+	}
+	fmt.Fprintf(&filter, ";[1:v]%s,split=%d", scale, metrics)
+	for i := 0; i < metrics; i++ {
+		fmt.Fprintf(&filter, "[r%d]", i)
+	}
+	fmt.Fprintf(&filter, ";[d0][r0]ssim=stats_file=%s;[d1][r1]psnr=stats_file=%s", filterPath(ssimPath), filterPath(psnrPath))
+	if withVMAF {
+		fmt.Fprintf(&filter, ";[d2][r2]libvmaf=log_fmt=json:log_path=%s", filterPath(vmafPath))
+	}
+
+	args := []string{
+		"-i", filepath.Join(s.BaseDir, videoID, quality.Name+".mp4"),
+		"-i", inputPath,
+		"-lavfi", filter.String(),
+		"-an",
+		"-f", "null",
+		os.DevNull,
+	}
+	if err := MediaEncoder.Run(args, nil); err != nil {
+		return nil, fmt.Errorf("failed to compare with source: %v", err)
+	}
+
+	scores := &models.QualityScores{MeasuredAt: time.Now()}
+	if scores.SSIM, err = readSSIM(ssimPath); err != nil {
+		return nil, fmt.Errorf("failed to read SSIM: %v", err)
+	}
+	if scores.PSNR, err = readPSNR(psnrPath); err != nil {
+		return nil, fmt.Errorf("failed to read PSNR: %v", err)
+	}
+	if withVMAF {
+		if scores.VMAF, err = readVMAF(vmafPath); err != nil {
+			return nil, fmt.Errorf("failed to read VMAF: %v", err)
+		}
+	}
+	return scores, nil
+}
+
+// filterPath 转义滤镜图中作为参数值的文件路径，ffmpeg 对参数先按滤镜图、再按选项各去除一层转义
+// 选项值中 \ ' : 需要转义，滤镜图中 \ ' [ ] , ; 需要转义。Windows 路径的 \ 先换成 /
+func filterPath(path string) string {
+	path = strings.NewReplacer(`\`, `\\`, `'`, `\'`, `:`, `\:`).Replace(filepath.ToSlash(path))
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`, `[`, `\[`, `]`, `\]`, `,`, `\,`, `;`, `\;`).Replace(path)
+}
+
+// Check 按计算出的最可靠的指标判断画质是否低于阈值，设置 BelowThreshold
+func (t QualityThresholds) Check(scores *models.QualityScores) {
+	switch {
+	case scores.VMAF != nil:
+		scores.BelowThreshold = t.VMAF > 0 && *scores.VMAF < t.VMAF
+	case scores.SSIM != nil:
+		scores.BelowThreshold = t.SSIM > 0 && *scores.SSIM < t.SSIM
+	case scores.PSNR != nil:
+		scores.BelowThreshold = t.PSNR > 0 && *scores.PSNR < t.PSNR
+	}
+}
+
+// formatScores 把计算出的分数格式化为日志中的 "VMAF 65.2, SSIM 0.912, PSNR 31.4dB"
+func formatScores(scores *models.QualityScores) string {
+	var parts []string
+	if scores.VMAF != nil {
+		parts = append(parts, fmt.Sprintf("VMAF %.1f", *scores.VMAF))
+	}
+	if scores.SSIM != nil {
+		parts = append(parts, fmt.Sprintf("SSIM %.3f", *scores.SSIM))
+	}
+	if scores.PSNR != nil {
+		parts = append(parts, fmt.Sprintf("PSNR %.1fdB", *scores.PSNR))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// readVMAF 读取 libvmaf 的 JSON 日志中的平均分，兼容 libvmaf 1.x 和 2.x 的格式
+func readVMAF(path string) (*float64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		PooledMetrics struct {
+			VMAF struct {
+				Mean *float64 `json:"mean"`
+			} `json:"vmaf"`
+		} `json:"pooled_metrics"`
+		Score *float64 `json:"VMAF score"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+	if result.PooledMetrics.VMAF.Mean != nil {
+		return result.PooledMetrics.VMAF.Mean, nil
+	}
+	if result.Score != nil {
+		return result.Score, nil
+	}
+	return nil, fmt.Errorf("no pooled score")
+}
+
+// readSSIM 计算 ssim 滤镜逐帧统计中 All 的平均值，每行形如 "n:1 Y:0.99 U:0.98 V:0.98 All:0.99 (20.1)"
+func readSSIM(path string) (*float64, error) {
+	var sum float64
+	n, err := readStats(path, "All", func(v float64) { sum += v })
+	if err != nil {
+		return nil, err
+	}
+	ssim := sum / float64(n)
+	return &ssim, nil
+}
+
+// readPSNR 按 psnr 滤镜逐帧统计中 mse_avg 的平均值计算整段的 PSNR，和 ffmpeg 输出的 average 一致
+// 清晰度都是 8 位的 yuv420p，峰值为 255。画面完全相同时 MSE 为 0，记为 100dB
+func readPSNR(path string) (*float64, error) {
+	var sum float64
+	n, err := readStats(path, "mse_avg", func(v float64) { sum += v })
+	if err != nil {
+		return nil, err
+	}
+	psnr := 100.0
+	if mse := sum / float64(n); mse > 0 {
+		psnr = math.Min(10*math.Log10(255*255/mse), psnr)
+	}
+	return &psnr, nil
+}
+
+// readStats 对统计文件每一行中 key 的值调用 fn，返回读取的行数
+func readStats(path, key string, fn func(v float64)) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	n := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		for _, field := range strings.Fields(scanner.Text()) {
+			name, value, ok := strings.Cut(field, ":")
+			if !ok || name != key {
+				continue
+			}
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid %s %q", key, value)
+			}
+			fn(v)
+			n++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("no frames compared")
+	}
+	return n, nil
+}
@@ -0,0 +1,117 @@
+package services
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"video-streaming/models"
+)
+
+// measureFixture 在名称包含 : ' , 的工作目录中准备 measureQuality 的输入，返回服务和源视频参数
+func measureFixture(t *testing.T) (*TranscodeService, *SourceInfo) {
+	t.Helper()
+	baseDir := filepath.Join(t.TempDir(), "it's:a,dir")
+	if err := os.MkdirAll(filepath.Join(baseDir, "video"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return NewTranscodeService(baseDir, nil), &SourceInfo{Width: 1920, Height: 1080, SARNum: 1, SARDen: 1, FPS: 30}
+}
+
+func TestMeasureQuality(t *testing.T) {
+	fake := NewFakeFFmpeg()
+	useFake(t, fake)
+	s, source := measureFixture(t)
+
+	scores, err := s.measureQuality("source.mp4", "video", source, models.Rendition{Name: "720p", Width: 1280, Height: 720})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scores.VMAF == nil || *scores.VMAF != 90 {
+		t.Errorf("VMAF = %v, want 90", scores.VMAF)
+	}
+	if scores.SSIM == nil || *scores.SSIM != 0.985 {
+		t.Errorf("SSIM = %v, want 0.985", scores.SSIM)
+	}
+	// 统计文件的 mse_avg 为 10
+	if want := 10 * math.Log10(255*255/10.0); scores.PSNR == nil || math.Abs(*scores.PSNR-want) > 1e-9 {
+		t.Errorf("PSNR = %v, want %v", scores.PSNR, want)
+	}
+
+	// 最后一次调用是比较，三个统计文件路径中的特殊字符都已转义，fake 按 ffmpeg 的规则还原后写入了统计文件
+	calls := fake.Calls()
+	args := calls[len(calls)-1]
+	filter := args[slices.Index(args, "-lavfi")+1]
+	if n := strings.Count(filter, `it\\\'s\\:a\,dir/metrics-`); n != 3 {
+		t.Errorf("filter has %d escaped stats paths, want 3: %s", n, filter)
+	}
+}
+
+func TestMeasureQualityWithoutVMAF(t *testing.T) {
+	useFake(t, NewFakeFFmpeg())
+	// 模拟没有编译 libvmaf 的 ffmpeg
+	vmafOnce.Do(func() { vmafAvailable = false })
+	s, source := measureFixture(t)
+
+	scores, err := s.measureQuality("source.mp4", "video", source, models.Rendition{Name: "480p", Width: 852, Height: 480})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scores.VMAF != nil {
+		t.Errorf("VMAF = %v, want nil", *scores.VMAF)
+	}
+	if scores.SSIM == nil || scores.PSNR == nil {
+		t.Fatalf("missing SSIM or PSNR: %s", formatScores(scores))
+	}
+
+	// 没有 VMAF 时按 SSIM 判断
+	DefaultQualityThresholds.Check(scores)
+	if scores.BelowThreshold {
+		t.Errorf("SSIM %.3f flagged below %.3f", *scores.SSIM, DefaultQualityThresholds.SSIM)
+	}
+	QualityThresholds{SSIM: 0.99, PSNR: 30}.Check(scores)
+	if !scores.BelowThreshold {
+		t.Errorf("SSIM %.3f not flagged below 0.99", *scores.SSIM)
+	}
+}
+
+func TestQualityThresholdsCheck(t *testing.T) {
+	f := func(v float64) *float64 { return &v }
+	tests := []struct {
+		name       string
+		thresholds QualityThresholds
+		scores     models.QualityScores
+		want       bool
+	}{
+		{"vmaf below", DefaultQualityThresholds, models.QualityScores{VMAF: f(65), SSIM: f(0.99), PSNR: f(45)}, true},
+		// VMAF 可用时不看 SSIM 和 PSNR
+		{"vmaf above", DefaultQualityThresholds, models.QualityScores{VMAF: f(80), SSIM: f(0.5), PSNR: f(20)}, false},
+		{"ssim below", DefaultQualityThresholds, models.QualityScores{SSIM: f(0.85), PSNR: f(45)}, true},
+		{"psnr below", DefaultQualityThresholds, models.QualityScores{PSNR: f(25)}, true},
+		{"disabled", QualityThresholds{SSIM: 0.9}, models.QualityScores{VMAF: f(10), SSIM: f(0.5)}, false},
+	}
+	for _, tt := range tests {
+		scores := tt.scores
+		tt.thresholds.Check(&scores)
+		if scores.BelowThreshold != tt.want {
+			t.Errorf("%s: below threshold = %v, want %v", tt.name, scores.BelowThreshold, tt.want)
+		}
+	}
+}
+
+func TestReadPSNRIdenticalFrames(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "psnr.log")
+	stats := "n:1 mse_avg:0.00 mse_y:0.00 mse_u:0.00 mse_v:0.00 psnr_avg:inf psnr_y:inf psnr_u:inf psnr_v:inf\n"
+	if err := os.WriteFile(path, []byte(stats), 0644); err != nil {
+		t.Fatal(err)
+	}
+	psnr, err := readPSNR(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *psnr != 100 {
+		t.Errorf("PSNR = %v, want 100", *psnr)
+	}
+}
@@ -0,0 +1,151 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"video-streaming/models"
+)
+
+const (
+	// ThumbnailDir 是工作目录和存储中缩略图的子目录
+	ThumbnailDir = "thumbnails"
+	// PosterFile 和 StoryboardFile 是缩略图目录中的封面和 WebVTT 缩略图轨道
+	PosterFile     = "poster.jpg"
+	StoryboardFile = "storyboard.vtt"
+
+	// 封面从这些帧中选出最有代表性的一帧
+	posterCandidateFrames = 100
+	// 故事板缩略图的宽度，高度按视频宽高比计算
+	storyboardThumbWidth = 160
+	storyboardColumns    = 10
+	storyboardRows       = 10
+	// 故事板至少间隔 2 秒一张，长视频加大间隔使数量不超过上限
+	storyboardMinInterval = 2
+	storyboardMaxThumbs   = 200
+)
+
+// ThumbnailService 从转码结果中生成封面、故事板雪碧图和 WebVTT 缩略图轨道
+type ThumbnailService struct {
+	BaseDir string
+}
+
+func NewThumbnailService(baseDir string) *ThumbnailService {
+	return &ThumbnailService{
+		BaseDir: baseDir,
+	}
+}
+
+// Generate 在工作目录的 thumbnails 子目录生成缩略图，失败时删除已生成的部分
+// 使用分辨率最高的清晰度作为输入，它已经按显示方向转正且是方形像素
+func (s *ThumbnailService) Generate(videoID string, renditions []models.Rendition) error {
+	if len(renditions) == 0 {
+		return fmt.Errorf("no renditions to generate thumbnails from")
+	}
+	largest := renditions[0]
+	for _, r := range renditions[1:] {
+		if r.Width*r.Height > largest.Width*largest.Height {
+			largest = r
+		}
+	}
+	inputPath := filepath.Join(s.BaseDir, videoID, largest.Name+".mp4")
+
+	_, metadata, err := probeMedia(inputPath)
+	if err != nil {
+		return fmt.Errorf("failed to probe %s: %v", largest.Name, err)
+	}
+
+	outputDir := filepath.Join(s.BaseDir, videoID, ThumbnailDir)
+	if err := os.RemoveAll(outputDir); err != nil {
+		return fmt.Errorf("failed to clean thumbnail directory: %v", err)
+	}
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return fmt.Errorf("failed to create thumbnail directory: %v", err)
+	}
+
+	err = s.generatePoster(inputPath, outputDir, metadata.Duration)
+	if err == nil {
+		err = s.generateStoryboard(inputPath, outputDir, metadata)
+	}
+	if err != nil {
+		os.RemoveAll(outputDir)
+		return err
+	}
+	return nil
+}
+
+// generatePoster 跳过片头后用 thumbnail 滤镜选帧，它选出直方图最接近这组帧平均值的一帧，
+// 可以避开黑屏、转场和闪白等不代表画面内容的帧
+func (s *ThumbnailService) generatePoster(inputPath, outputDir string, duration float64) error {
+	outputPath := filepath.Join(outputDir, PosterFile)
+	args := []string{
+		"-ss", fmt.Sprintf("%.3f", duration*0.1),
+		"-i", inputPath,
+		"-vf", fmt.Sprintf("thumbnail=%d", posterCandidateFrames),
+		"-frames:v", "1",
+		"-an",
+		"-q:v", "2",
+		"-y",
+		outputPath,
+	}
+	if err := MediaEncoder.Run(args, nil); err != nil {
+		return fmt.Errorf("failed to generate poster: %v", err)
+	}
+	if _, err := os.Stat(outputPath); err != nil {
+		return fmt.Errorf("poster was not generated: %v", err)
+	}
+	return nil
+}
+
+// generateStoryboard 按固定间隔截取缩略图拼成雪碧图，并生成引用雪碧图区域的 WebVTT 轨道
+func (s *ThumbnailService) generateStoryboard(inputPath, outputDir string, metadata *models.MediaMetadata) error {
+	if metadata.Duration <= 0 {
+		return fmt.Errorf("unknown duration")
+	}
+	if metadata.Video == nil || metadata.Video.Width <= 0 || metadata.Video.Height <= 0 {
+		return fmt.Errorf("unknown video size")
+	}
+
+	interval := max(storyboardMinInterval, int(math.Ceil(metadata.Duration/storyboardMaxThumbs)))
+	width := storyboardThumbWidth
+	height := evenSize(float64(width) * float64(metadata.Video.Height) / float64(metadata.Video.Width))
+
+	// tile 滤镜在结尾输出未填满的最后一张雪碧图
+	args := []string{
+		"-i", inputPath,
+		"-vf", fmt.Sprintf("fps=1/%d,scale=%d:%d,tile=%dx%d", interval, width, height, storyboardColumns, storyboardRows),
+		"-an",
+		"-q:v", "5",
+		"-y",
+		filepath.Join(outputDir, "storyboard_%03d.jpg"),
+	}
+	if err := MediaEncoder.Run(args, nil); err != nil {
+		return fmt.Errorf("failed to generate storyboard: %v", err)
+	}
+
+	var vtt strings.Builder
+	vtt.WriteString("WEBVTT\n")
+	perSprite := storyboardColumns * storyboardRows
+	count := int(math.Ceil(metadata.Duration / float64(interval)))
+	for i := 0; i < count; i++ {
+		start := float64(i * interval)
+		end := math.Min(float64((i+1)*interval), metadata.Duration)
+		tile := i % perSprite
+		// 相对地址，播放器按 VTT 文件的地址解析
+		fmt.Fprintf(&vtt, "\n%s --> %s\nstoryboard_%03d.jpg#xywh=%d,%d,%d,%d\n",
+			formatVTTTime(start), formatVTTTime(end), i/perSprite+1,
+			tile%storyboardColumns*width, tile/storyboardColumns*height, width, height)
+	}
+	if err := os.WriteFile(filepath.Join(outputDir, StoryboardFile), []byte(vtt.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write storyboard track: %v", err)
+	}
+	return nil
+}
+
+// formatVTTTime 把秒数格式化为 WebVTT 的 HH:MM:SS.mmm
+func formatVTTTime(seconds float64) string {
+	ms := int64(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
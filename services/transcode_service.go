@@ -1,242 +1,388 @@
 package services
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"sync"
+	"strings"
+	"time"
 	"video-streaming/models"
+	"video-streaming/storage"
 )
 
-const (
-	VideoDir = "./videos"
-)
-
+// TranscodeService 从存储读取原始文件，转码结果先写入本地工作目录 BaseDir
+// 转码阶梯来自视频上传时选择的编码配置
 type TranscodeService struct {
 	BaseDir   string
-	Qualities []Quality
-}
+	Storage   storage.Storage
+	Packaging PackagingFormat
+	Progress  *ProgressTracker
 
-type Quality struct {
-	Name       string
-	Resolution string
-	Bitrate    string
+	// QualityMetrics 为 true 时转码后计算各清晰度相对源视频的画质分数，低于 Thresholds 的被标记
+	QualityMetrics bool
+	Thresholds     QualityThresholds
 }
 
-func NewTranscodeService(baseDir string) *TranscodeService {
+func NewTranscodeService(baseDir string, store storage.Storage) *TranscodeService {
 	return &TranscodeService{
-		BaseDir: baseDir,
-		Qualities: []Quality{
-			{Name: "1080p", Resolution: "1920x1080", Bitrate: "4000k"},
-			{Name: "720p", Resolution: "1280x720", Bitrate: "2500k"},
-			{Name: "480p", Resolution: "854x480", Bitrate: "1000k"},
-		},
+		BaseDir:    baseDir,
+		Storage:    store,
+		Packaging:  PackagingAll,
+		Progress:   NewProgressTracker(),
+		Thresholds: DefaultQualityThresholds,
 	}
 }
 
-func (s *TranscodeService) TranscodeVideo(uploadID string) error {
-	inputPath := filepath.Join(s.BaseDir, uploadID, "original.mp4")
+// TranscodeVideo 按视频的编码配置转码，返回生成的清晰度
+func (s *TranscodeService) TranscodeVideo(uploadID string) ([]models.Rendition, error) {
+	ctx := context.Background()
+	key := uploadID + "/original.mp4"
+
+	profile, err := models.GetVideoProfile(uploadID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get encoding profile: %v", err)
+	}
 
 	// 检查输入文件
-	if _, err := os.Stat(inputPath); os.IsNotExist(err) {
-		return fmt.Errorf("input video not found at %s: %v", inputPath, err)
+	fileInfo, err := s.Storage.Stat(ctx, key)
+	if errors.Is(err, storage.ErrNotExist) {
+		return nil, fmt.Errorf("input video %s not found", key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file info: %v", err)
+	}
+	if fileInfo.Size == 0 {
+		return nil, fmt.Errorf("input file is empty")
 	}
 
-	// 检查文件大小
-	fileInfo, err := os.Stat(inputPath)
+	// ffmpeg 直接读取存储中的文件，本地后端是文件路径，S3 是预签名 URL
+	inputPath, err := storage.Locate(ctx, s.Storage, key)
 	if err != nil {
-		return fmt.Errorf("failed to get file info: %v", err)
+		return nil, fmt.Errorf("failed to locate input file: %v", err)
 	}
-	if fileInfo.Size() == 0 {
-		return fmt.Errorf("input file is empty")
+	if err := os.MkdirAll(filepath.Join(s.BaseDir, uploadID), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create work directory: %v", err)
 	}
 
-	log.Printf("Starting transcoding for upload %s, input file size: %d bytes", uploadID, fileInfo.Size())
+	log.Printf("Starting transcoding for upload %s with profile %s, input file size: %d bytes", uploadID, profile.Name, fileInfo.Size)
 
-	// 验证输入文件
-	if err := s.verifyInputFile(inputPath); err != nil {
-		return fmt.Errorf("input file verification failed: %v", err)
+	// 读取源视频参数，同时验证输入文件
+	source, sourceMetadata, err := probeMedia(inputPath)
+	if err != nil {
+		return nil, fmt.Errorf("input file verification failed: %v", err)
 	}
+	// 时长用于计算进度，无法获取时为 0，只影响进度显示
+	duration := sourceMetadata.Duration
 
-	var wg sync.WaitGroup
-	errors := make(chan error, len(s.Qualities))
+	// 只生成不高于源分辨率的清晰度
+	renditions := fitRenditions(source, profile.Renditions)
+	if len(renditions) == 0 {
+		return nil, fmt.Errorf("profile %s has no renditions", profile.Name)
+	}
+	srcW, srcH := source.DisplaySize()
+	log.Printf("Source of %s is %dx%d (rotation %d, %.3f fps), generating %d of %d renditions",
+		uploadID, srcW, srcH, source.Rotation, source.FPS, len(renditions), len(profile.Renditions))
+
+	// 分析失败时使用配置的固定阶梯，不影响转码
+	var analysis *models.LadderAnalysis
+	if profile.PerTitle {
+		adjusted, a, err := s.analyzeLadder(inputPath, uploadID, source, duration, renditions)
+		if err != nil {
+			log.Printf("Per-title analysis of %s failed, using the fixed ladder: %v", uploadID, err)
+		} else {
+			renditions, analysis = adjusted, a
+			log.Printf("Per-title analysis of %s: complexity %.4f bits per pixel", uploadID, a.Complexity)
+		}
+	}
+
+	names := make([]string, len(renditions))
+	for i, r := range renditions {
+		names[i] = r.Name
+	}
+	s.Progress.Start(uploadID, duration, names)
+	defer s.Progress.Finish(uploadID)
+
+	metadata := map[string]*models.MediaMetadata{models.MetadataOriginal: sourceMetadata}
+	started := time.Now()
 
-	for _, quality := range s.Qualities {
-		wg.Add(1)
-		go func(q Quality) {
-			defer wg.Done()
-			if err := s.transcodeToQuality(inputPath, uploadID, q); err != nil {
-				errors <- fmt.Errorf("failed to transcode to %s: %v", q.Name, err)
+	if profile.SingleDecode {
+		if err := s.transcodeShared(inputPath, uploadID, renditions, source.FPS, duration, metadata); err != nil {
+			return nil, err
+		}
+	} else {
+		// 每个任务内按顺序转码，同时运行的 ffmpeg 数量由任务队列的工作协程数决定
+		for _, quality := range renditions {
+			m, err := s.transcodeToQuality(inputPath, uploadID, quality, source.FPS, duration)
+			if err != nil {
+				s.Progress.Update(uploadID, quality.Name, func(r *RenditionProgress) {
+					r.Status = "failed"
+				})
+				return nil, fmt.Errorf("failed to transcode to %s: %v", quality.Name, err)
+			}
+			metadata[quality.Name] = m
+		}
+	}
+	log.Printf("Transcoded %s to %d renditions in %s (single decode: %v)",
+		uploadID, len(renditions), time.Since(started).Round(time.Millisecond), profile.SingleDecode)
+
+	// 画质分数只用于评估，计算失败不影响转码结果
+	scores := make(map[string]*models.QualityScores)
+	if s.QualityMetrics {
+		for _, quality := range renditions {
+			sc, err := s.measureQuality(inputPath, uploadID, source, quality)
+			if err != nil {
+				log.Printf("Failed to measure quality of %s for %s: %v", quality.Name, uploadID, err)
+				continue
+			}
+			s.Thresholds.Check(sc)
+			if sc.BelowThreshold {
+				log.Printf("Rendition %s of %s is below the quality threshold: %s", quality.Name, uploadID, formatScores(sc))
 			}
-		}(quality)
+			scores[quality.Name] = sc
+		}
 	}
 
-	// 等待所有转码完成
-	wg.Wait()
-	close(errors)
+	if err := s.recordQualities(uploadID, renditions, metadata, scores); err != nil {
+		return nil, err
+	}
+	if analysis != nil {
+		err = models.SaveLadderAnalysis(analysis)
+	} else {
+		err = models.DeleteLadderAnalysis(uploadID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to record ladder analysis: %v", err)
+	}
+	return renditions, nil
+}
 
-	// 检查是否有错误发生
-	for err := range errors {
-		if err != nil {
-			return err
+// recordQualities 把生成的清晰度、各文件的元数据和画质分数写入数据库，重新转码时覆盖旧记录
+func (s *TranscodeService) recordQualities(videoID string, renditions []models.Rendition, metadata map[string]*models.MediaMetadata, scores map[string]*models.QualityScores) error {
+	if err := models.DeleteQualities(videoID); err != nil {
+		return fmt.Errorf("failed to clear quality records: %v", err)
+	}
+	if err := models.DeleteRenditionMetadata(videoID); err != nil {
+		return fmt.Errorf("failed to clear metadata records: %v", err)
+	}
+	for rendition, m := range metadata {
+		if err := models.SaveMetadata(videoID, rendition, m); err != nil {
+			return fmt.Errorf("failed to save metadata of %s: %v", rendition, err)
 		}
 	}
 
+	for _, quality := range renditions {
+		fileInfo, err := os.Stat(filepath.Join(s.BaseDir, videoID, quality.Name+".mp4"))
+		if err != nil {
+			return fmt.Errorf("failed to get file info: %v", err)
+		}
+
+		record := &models.Quality{
+			VideoID:    videoID,
+			Resolution: quality.Name,
+			Width:      quality.Width,
+			Height:     quality.Height,
+			Path:       fmt.Sprintf("/api/videos/%s/stream?quality=%s", videoID, quality.Name),
+			Size:       fileInfo.Size(),
+			Scores:     scores[quality.Name],
+		}
+		if err := models.CreateQuality(record); err != nil {
+			return fmt.Errorf("failed to create quality record: %v", err)
+		}
+	}
 	return nil
 }
 
-func (s *TranscodeService) transcodeToQuality(inputPath, uploadID string, quality Quality) error {
-	outputPath := filepath.Join(s.BaseDir, uploadID, fmt.Sprintf("%s.mp4", quality.Name))
-
-	// 修改 FFmpeg 命令参数，添加更多参数确保生成正确的 MP4 文件
-	args := []string{
-		"-i", inputPath,
-		"-c:v", "libx264",
-		"-preset", "medium",
-		"-profile:v", "main",
-		"-level", "4.0",
-		"-crf", "23",
-		"-s", quality.Resolution,
-		"-b:v", quality.Bitrate,
-		"-c:a", "aac",
-		"-b:a", "128k",
-		"-movflags", "+faststart", // 确保 moov atom 在文件开头
-		"-y",        // 覆盖已存在的文件
-		"-f", "mp4", // 强制输出格式为 MP4
-		"-strict", "experimental", // 允许实验性编码器
-		outputPath,
+// transcodeToQuality 转码一个清晰度，返回输出文件的技术参数
+func (s *TranscodeService) transcodeToQuality(inputPath, uploadID string, quality models.Rendition, fps, duration float64) (*models.MediaMetadata, error) {
+	workDir := filepath.Join(s.BaseDir, uploadID)
+	outputPath := filepath.Join(workDir, fmt.Sprintf("%s.mp4", quality.Name))
+	passes := encodePasses(quality)
+	passLog := passLogPrefix(workDir, quality.Name)
+
+	s.Progress.Update(uploadID, quality.Name, func(r *RenditionProgress) {
+		r.Status = "running"
+	})
+
+	args := []string{"-i", inputPath}
+	if passes == 2 {
+		defer removePassLogs(passLog)
+		firstPass := append([]string{"-i", inputPath, "-vf", scaleFilter(quality)}, firstPassArgs(quality, fps, passLog)...)
+		err := MediaEncoder.Run(append(firstPass, "-y", os.DevNull), func(p FFmpegProgress) {
+			s.updateProgress(uploadID, quality.Name, p, duration, 1, passes)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("first pass failed: %v", err)
+		}
+		args = append(args, passArgs(quality, 2, passLog)...)
 	}
 
-	cmd := exec.Command("ffmpeg", args...)
+	args = append(args, encodeArgs(quality, fps)...)
+	args = append(args,
+		"-y",                      // 覆盖已存在的文件
+		"-strict", "experimental", // 允许实验性编码器
+		outputPath,
+	)
 
-	// 捕获输出
-	output, err := cmd.CombinedOutput()
+	// 解析 -progress 输出实时更新进度
+	err := MediaEncoder.Run(args, func(p FFmpegProgress) {
+		s.updateProgress(uploadID, quality.Name, p, duration, passes, passes)
+	})
 	if err != nil {
-		return fmt.Errorf("ffmpeg error: %v\nOutput: %s", err, string(output))
+		return nil, err
 	}
 
 	// 验证输出文件
-	if err := s.verifyOutputFile(outputPath); err != nil {
-		return fmt.Errorf("output file verification failed: %v", err)
+	metadata, err := s.verifyOutputFile(outputPath)
+	if err != nil {
+		return nil, fmt.Errorf("output file verification failed: %v", err)
 	}
 
-	return nil
+	s.Progress.Update(uploadID, quality.Name, func(r *RenditionProgress) {
+		r.Status = "done"
+		r.Percent = 100
+		r.ETA = 0
+	})
+
+	return metadata, nil
 }
 
-// 添加新方法：验证输出文件
-func (s *TranscodeService) verifyOutputFile(filePath string) error {
-	// 检查文件是否存在
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		return fmt.Errorf("output file does not exist: %s", filePath)
+// transcodeShared 只解码一次源视频，用 split 滤镜把画面分给各清晰度，在同一个 ffmpeg 中编码
+// 省去重复解码的 CPU 和内存，但所有清晰度一起成功或失败，进度也相同
+// 有两遍编码的清晰度时先对这些清晰度运行一次共享解码的第一遍
+func (s *TranscodeService) transcodeShared(inputPath, uploadID string, renditions []models.Rendition, fps, duration float64, metadata map[string]*models.MediaMetadata) error {
+	// split 滤镜至少要有一个输出
+	if len(renditions) == 0 {
+		return fmt.Errorf("no renditions to transcode")
 	}
+	workDir := filepath.Join(s.BaseDir, uploadID)
 
-	// 使用 ffprobe 检查文件
-	cmd := exec.Command("ffprobe",
-		"-v", "error",
-		"-select_streams", "v:0",
-		"-show_entries", "stream=codec_name,width,height",
-		"-of", "json",
-		filePath,
-	)
+	setStatus := func(status string) {
+		for _, quality := range renditions {
+			s.Progress.Update(uploadID, quality.Name, func(r *RenditionProgress) {
+				r.Status = status
+			})
+		}
+	}
+	setStatus("running")
 
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("ffprobe error: %v\nOutput: %s", err, string(output))
+	var twoPass []models.Rendition
+	for _, quality := range renditions {
+		if encodePasses(quality) == 2 {
+			twoPass = append(twoPass, quality)
+			defer removePassLogs(passLogPrefix(workDir, quality.Name))
+		}
+	}
+	if len(twoPass) > 0 {
+		args := []string{"-i", inputPath, "-filter_complex", splitFilter(twoPass)}
+		for i, quality := range twoPass {
+			args = append(args, "-map", fmt.Sprintf("[v%d]", i))
+			args = append(args, firstPassArgs(quality, fps, passLogPrefix(workDir, quality.Name))...)
+			args = append(args, "-y", os.DevNull)
+		}
+		err := MediaEncoder.Run(args, func(p FFmpegProgress) {
+			for _, quality := range twoPass {
+				s.updateProgress(uploadID, quality.Name, p, duration, 1, 2)
+			}
+		})
+		if err != nil {
+			setStatus("failed")
+			return fmt.Errorf("first pass failed: %v", err)
+		}
 	}
 
-	// 检查文件大小
-	fileInfo, err := os.Stat(filePath)
-	if err != nil {
-		return fmt.Errorf("failed to get file info: %v", err)
+	args := []string{"-i", inputPath, "-filter_complex", splitFilter(renditions)}
+	outputs := make([]string, len(renditions))
+	for i, quality := range renditions {
+		outputs[i] = filepath.Join(workDir, quality.Name+".mp4")
+		// 每个输出映射自己的画面和源文件的第一条音轨，源文件没有音轨时忽略
+		args = append(args, "-map", fmt.Sprintf("[v%d]", i), "-map", "0:a:0?")
+		if encodePasses(quality) == 2 {
+			args = append(args, passArgs(quality, 2, passLogPrefix(workDir, quality.Name))...)
+		}
+		args = append(args, codecArgs(quality, fps)...)
+		args = append(args, "-y", "-strict", "experimental", outputs[i])
 	}
 
-	if fileInfo.Size() == 0 {
-		return fmt.Errorf("output file is empty")
+	err := MediaEncoder.Run(args, func(p FFmpegProgress) {
+		for _, quality := range renditions {
+			passes := encodePasses(quality)
+			s.updateProgress(uploadID, quality.Name, p, duration, passes, passes)
+		}
+	})
+	if err != nil {
+		setStatus("failed")
+		return fmt.Errorf("failed to transcode renditions: %v", err)
 	}
 
+	for i, quality := range renditions {
+		m, err := s.verifyOutputFile(outputs[i])
+		if err != nil {
+			setStatus("failed")
+			return fmt.Errorf("output file verification failed for %s: %v", quality.Name, err)
+		}
+		metadata[quality.Name] = m
+		s.Progress.Update(uploadID, quality.Name, func(r *RenditionProgress) {
+			r.Status = "done"
+			r.Percent = 100
+			r.ETA = 0
+		})
+	}
 	return nil
 }
 
-// 添加新方法：验证输入文件
-func (s *TranscodeService) verifyInputFile(filePath string) error {
-	cmd := exec.Command("ffprobe",
-		"-v", "error",
-		"-select_streams", "v:0",
-		"-show_entries", "stream=codec_name,width,height",
-		"-of", "json",
-		filePath,
-	)
-
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("ffprobe error: %v\nOutput: %s", err, string(output))
+// splitFilter 返回把源视频画面分给各清晰度并分别缩放的滤镜图，第 i 个清晰度的输出标签是 [vi]
+func splitFilter(renditions []models.Rendition) string {
+	var filter strings.Builder
+	fmt.Fprintf(&filter, "[0:v]split=%d", len(renditions))
+	for i := range renditions {
+		fmt.Fprintf(&filter, "[s%d]", i)
 	}
-
-	return nil
+	for i, quality := range renditions {
+		fmt.Fprintf(&filter, ";[s%d]%s[v%d]", i, scaleFilter(quality), i)
+	}
+	return filter.String()
 }
 
-func TranscodeVideo(videoID string, inputPath string) error {
-	// 创建视频目录
-	videoDir := filepath.Join(VideoDir, videoID)
-	if err := os.MkdirAll(videoDir, 0755); err != nil {
-		return fmt.Errorf("failed to create video directory: %v", err)
-	}
-
-	// 定义转码配置
-	qualities := []struct {
-		resolution string
-		bitrate    string
-	}{
-		{"720p", "2000k"},
-		{"1080p", "4000k"},
-	}
-
-	// 执行转码
-	for _, quality := range qualities {
-		outputPath := filepath.Join(videoDir, quality.resolution+".mp4")
-
-		// 构建 ffmpeg 命令
-		cmd := exec.Command("ffmpeg",
-			"-i", inputPath,
-			"-c:v", "libx264",
-			"-b:v", quality.bitrate,
-			"-c:a", "aac",
-			"-b:a", "128k",
-			"-vf", fmt.Sprintf("scale=-2:%s", quality.resolution),
-			"-y",
-			outputPath,
-		)
-
-		// 执行命令
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("failed to transcode to %s: %v", quality.resolution, err)
-		}
-
-		// 获取文件大小
-		fileInfo, err := os.Stat(outputPath)
-		if err != nil {
-			return fmt.Errorf("failed to get file info: %v", err)
+// updateProgress 用 ffmpeg 的 -progress 输出更新一个清晰度的进度
+// 两遍编码时每一遍占一半进度，pass 是当前的遍数，passes 是总遍数
+func (s *TranscodeService) updateProgress(uploadID, name string, p FFmpegProgress, duration float64, pass, passes int) {
+	s.Progress.Update(uploadID, name, func(r *RenditionProgress) {
+		r.OutTime = p.OutTime
+		r.Speed = p.Speed
+		if passes > 1 {
+			r.Pass = pass
 		}
-
-		// 创建质量记录
-		quality := &models.Quality{
-			VideoID:    videoID,
-			Resolution: quality.resolution,
-			Path:       fmt.Sprintf("/api/videos/%s/stream?quality=%s", videoID, quality.resolution),
-			Size:       fileInfo.Size(),
+		if duration > 0 {
+			done := min(p.OutTime/duration, 1)
+			r.Percent = (float64(pass-1) + done) / float64(passes) * 100
+			if p.Speed > 0 {
+				r.ETA = (max(duration-p.OutTime, 0) + float64(passes-pass)*duration) / p.Speed
+			}
 		}
+	})
+}
 
-		if err := models.CreateQuality(quality); err != nil {
-			return fmt.Errorf("failed to create quality record: %v", err)
-		}
+// verifyOutputFile 验证输出文件，返回文件的技术参数
+func (s *TranscodeService) verifyOutputFile(filePath string) (*models.MediaMetadata, error) {
+	// 检查文件大小
+	fileInfo, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("output file does not exist: %s", filePath)
 	}
-
-	// 删除临时文件
-	if err := os.Remove(inputPath); err != nil {
-		fmt.Printf("Warning: failed to remove temp file: %v\n", err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file info: %v", err)
+	}
+	if fileInfo.Size() == 0 {
+		return nil, fmt.Errorf("output file is empty")
 	}
 
-	return nil
+	// 使用 ffprobe 检查文件
+	_, metadata, err := probeMedia(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return metadata, nil
 }
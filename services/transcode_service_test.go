@@ -0,0 +1,103 @@
+package services
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"video-streaming/models"
+)
+
+// 基准测试使用的阶梯，和默认配置相同的参数，尺寸按测试片段缩小
+var benchRenditions = []models.Rendition{
+	{Name: "360p", Width: 640, Height: 360, VideoCodec: "libx264", Preset: "veryfast", RateControl: models.RateControlCRF, CRF: 23, MaxRate: "1000k", BufSize: "2000k", AudioBitrate: "128k", Container: "mp4"},
+	{Name: "240p", Width: 426, Height: 240, VideoCodec: "libx264", Preset: "veryfast", RateControl: models.RateControlCRF, CRF: 23, MaxRate: "500k", BufSize: "1000k", AudioBitrate: "128k", Container: "mp4"},
+	{Name: "180p", Width: 320, Height: 180, VideoCodec: "libx264", Preset: "veryfast", RateControl: models.RateControlCRF, CRF: 23, MaxRate: "300k", BufSize: "600k", AudioBitrate: "128k", Container: "mp4"},
+}
+
+// benchClip 用 ffmpeg 生成 5 秒 640x360 带音轨的测试片段，本机没有 ffmpeg 时跳过
+func benchClip(b *testing.B) (string, *SourceInfo, float64) {
+	b.Helper()
+	for _, name := range []string{"ffmpeg", "ffprobe"} {
+		if _, err := exec.LookPath(name); err != nil {
+			b.Skipf("%s not installed", name)
+		}
+	}
+
+	prober, encoder := MediaProber, MediaEncoder
+	MediaProber, MediaEncoder = ExecProber{}, ExecEncoder{}
+	b.Cleanup(func() { MediaProber, MediaEncoder = prober, encoder })
+
+	clip := filepath.Join(b.TempDir(), "clip.mp4")
+	err := MediaEncoder.Run([]string{
+		"-f", "lavfi", "-i", "testsrc2=size=640x360:rate=30:duration=5",
+		"-f", "lavfi", "-i", "sine=frequency=440:duration=5",
+		"-c:v", "libx264", "-preset", "veryfast", "-pix_fmt", "yuv420p",
+		"-c:a", "aac", "-shortest",
+		"-y", clip,
+	}, nil)
+	if err != nil {
+		b.Fatalf("failed to generate clip: %v", err)
+	}
+
+	source, metadata, err := probeMedia(clip)
+	if err != nil {
+		b.Fatalf("failed to probe clip: %v", err)
+	}
+	return clip, source, metadata.Duration
+}
+
+// newBenchService 返回工作目录在临时目录中的 TranscodeService，不需要存储和数据库
+// 和 TranscodeVideo 一样预先创建视频 "bench" 的工作目录
+func newBenchService(b *testing.B) *TranscodeService {
+	b.Helper()
+	s := NewTranscodeService(b.TempDir(), nil)
+	if err := os.MkdirAll(filepath.Join(s.BaseDir, "bench"), 0755); err != nil {
+		b.Fatal(err)
+	}
+	return s
+}
+
+// BenchmarkTranscodePerRendition 每个清晰度单独运行一次 ffmpeg，源视频解码多次
+func BenchmarkTranscodePerRendition(b *testing.B) {
+	clip, source, duration := benchClip(b)
+	s := newBenchService(b)
+	renditions := fitRenditions(source, benchRenditions)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, quality := range renditions {
+			if _, err := s.transcodeToQuality(clip, "bench", quality, source.FPS, duration); err != nil {
+				b.Fatalf("failed to transcode to %s: %v", quality.Name, err)
+			}
+		}
+	}
+}
+
+// BenchmarkTranscodeSingleDecode 所有清晰度在同一个 ffmpeg 中编码，源视频只解码一次
+func BenchmarkTranscodeSingleDecode(b *testing.B) {
+	clip, source, duration := benchClip(b)
+	s := newBenchService(b)
+	renditions := fitRenditions(source, benchRenditions)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		metadata := make(map[string]*models.MediaMetadata)
+		if err := s.transcodeShared(clip, "bench", renditions, source.FPS, duration, metadata); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestTranscodeSharedRejectsEmptyRenditions(t *testing.T) {
+	fake := NewFakeFFmpeg()
+	useFake(t, fake)
+
+	s := NewTranscodeService(t.TempDir(), nil)
+	if err := s.transcodeShared("input.mp4", "empty", nil, 30, 10, map[string]*models.MediaMetadata{}); err == nil {
+		t.Fatal("expected an error for empty renditions")
+	}
+	if calls := fake.Calls(); len(calls) != 0 {
+		t.Fatalf("ffmpeg should not run, got %v", calls)
+	}
+}
@@ -1,45 +1,671 @@
 package services
 
 import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"video-streaming/events"
+	"video-streaming/models"
+	"video-streaming/storage"
 )
 
+// UploadSessionTTL 是上传会话的有效期，过期后未完成的上传会被清理
+const UploadSessionTTL = 24 * time.Hour
+
+// TusDataFile 是 tus 上传的数据文件，位于 BaseDir/<id>/ 下
+const TusDataFile = "upload.bin"
+
+// ErrUploadNotActive 表示上传已完成、已中止或已过期
+var ErrUploadNotActive = errors.New("upload is not active")
+
+// ErrDirectUploadUnsupported 表示存储后端不支持客户端直传分段
+var ErrDirectUploadUnsupported = errors.New("storage backend does not support direct uploads")
+
+// UploadService 管理上传会话，分片和 tus 数据暂存在本地 BaseDir，合并后写入存储
 type UploadService struct {
 	BaseDir string
+	Storage storage.Storage
+	Queue   *JobQueue
 }
 
-func NewUploadService(baseDir string) *UploadService {
+func NewUploadService(baseDir string, store storage.Storage, queue *JobQueue) *UploadService {
 	return &UploadService{
 		BaseDir: baseDir,
+		Storage: store,
+		Queue:   queue,
 	}
 }
 
-func (s *UploadService) MergeChunks(uploadID string, totalChunks int) error {
-	uploadPath := filepath.Join(s.BaseDir, uploadID)
-	outputPath := filepath.Join(s.BaseDir, uploadID, "original.mp4")
+// ChunkInfo 描述一个已完整写入的分片
+type ChunkInfo struct {
+	Index int    `json:"index"`
+	Size  int64  `json:"size"`
+	Name  string `json:"-"`
+}
+
+// ListChunks 返回已完整写入的分片，按序号排序
+// direct 模式的分片是存储后端中的分段，其余在上传目录中
+func (s *UploadService) ListChunks(session *models.UploadSession) ([]ChunkInfo, error) {
+	if session.Mode == models.UploadModeDirect {
+		parts, err := s.listParts(session)
+		if err != nil {
+			return nil, err
+		}
+		return partChunks(parts), nil
+	}
+	// tus 上传只有一个数据文件，作为唯一的分片合并
+	if session.Protocol == models.UploadProtocolTus {
+		info, err := os.Stat(filepath.Join(s.BaseDir, session.ID, TusDataFile))
+		if err != nil {
+			return nil, err
+		}
+		return []ChunkInfo{{Index: 0, Size: info.Size(), Name: TusDataFile}}, nil
+	}
 
-	outputFile, err := os.Create(outputPath)
+	files, err := os.ReadDir(filepath.Join(s.BaseDir, session.ID))
 	if err != nil {
-		return fmt.Errorf("failed to create output file: %v", err)
+		return nil, err
 	}
-	defer outputFile.Close()
 
-	for i := 0; i < totalChunks; i++ {
-		chunkPath := filepath.Join(uploadPath, fmt.Sprintf("chunk_%d", i))
-		chunkFile, err := os.Open(chunkPath)
+	var chunks []ChunkInfo
+	for _, f := range files {
+		if f.IsDir() || !strings.HasPrefix(f.Name(), "chunk_") {
+			continue
+		}
+		// 忽略正在写入的 .part 文件
+		index, err := strconv.Atoi(strings.TrimPrefix(f.Name(), "chunk_"))
+		if err != nil {
+			continue
+		}
+		info, err := f.Info()
 		if err != nil {
-			return fmt.Errorf("failed to open chunk %d: %v", i, err)
+			return nil, err
+		}
+		chunks = append(chunks, ChunkInfo{Index: index, Size: info.Size(), Name: f.Name()})
+	}
+
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].Index < chunks[j].Index
+	})
+	return chunks, nil
+}
+
+// MissingChunks 返回缺失的分片序号和已收到的字节数
+func MissingChunks(session *models.UploadSession, chunks []ChunkInfo) ([]int, int64) {
+	var missing []int
+	var received int64
+	next := 0
+	for _, chunk := range chunks {
+		for ; next < chunk.Index; next++ {
+			missing = append(missing, next)
+		}
+		next = chunk.Index + 1
+		received += chunk.Size
+	}
+	for ; next < session.ChunkCount; next++ {
+		missing = append(missing, next)
+	}
+	return missing, received
+}
+
+// ExpectedChunkSize 返回指定分片应有的字节数，最后一个分片可能较小
+func ExpectedChunkSize(session *models.UploadSession, index int) int64 {
+	if index == session.ChunkCount-1 {
+		return session.FileSize - int64(index)*session.ChunkSize
+	}
+	return session.ChunkSize
+}
+
+// InvalidChunks 返回大小与声明不符的分片序号
+// 直传的分段不经过本服务，只能在合并前检查
+func InvalidChunks(session *models.UploadSession, chunks []ChunkInfo) []int {
+	var invalid []int
+	for _, chunk := range chunks {
+		if chunk.Index >= session.ChunkCount || chunk.Size != ExpectedChunkSize(session, chunk.Index) {
+			invalid = append(invalid, chunk.Index)
 		}
+	}
+	return invalid
+}
+
+// DirectChunkSize 返回直传时的分片大小
+// 不小于存储后端的最小分段，文件很大时增大分片使分段数不超过上限
+func DirectChunkSize(fileSize int64) int64 {
+	size := int64(storage.MinPartSize)
+	if n := (fileSize + storage.MaxParts - 1) / storage.MaxParts; n > size {
+		const mb = 1024 * 1024
+		size = (n + mb - 1) / mb * mb
+	}
+	return size
+}
+
+// PartURLBatch 是一次返回的预签名 URL 的数量上限，其余的由客户端通过上传状态接口分批获取
+const PartURLBatch = 100
+
+// PartURL 是直传一个分片的预签名 URL
+type PartURL struct {
+	ChunkIndex int    `json:"chunkIndex"`
+	PartNumber int    `json:"partNumber"`
+	URL        string `json:"url"`
+}
+
+func (s *UploadService) multipart() (storage.MultipartUploader, error) {
+	m, ok := s.Storage.(storage.MultipartUploader)
+	if !ok {
+		return nil, ErrDirectUploadUnsupported
+	}
+	return m, nil
+}
+
+// CreateDirectUpload 在存储后端开始分段上传，分段上传 ID 记录在 session 中
+func (s *UploadService) CreateDirectUpload(session *models.UploadSession) error {
+	m, err := s.multipart()
+	if err != nil {
+		return err
+	}
+	id, err := m.CreateMultipartUpload(context.Background(), session.VideoID+"/original.mp4")
+	if err != nil {
+		return err
+	}
+	session.Mode = models.UploadModeDirect
+	session.MultipartID = id
+	return nil
+}
+
+// CancelDirectUpload 放弃存储后端的分段上传，用于会话还没有记录时的失败清理
+func (s *UploadService) CancelDirectUpload(session *models.UploadSession) error {
+	m, err := s.multipart()
+	if err != nil {
+		return err
+	}
+	return m.AbortMultipartUpload(context.Background(), session.VideoID+"/original.mp4", session.MultipartID)
+}
 
-		_, err = io.Copy(outputFile, chunkFile)
-		chunkFile.Close()
+// PresignChunks 为指定的分片生成上传 URL，有效期到会话过期为止
+func (s *UploadService) PresignChunks(session *models.UploadSession, indices []int) ([]PartURL, error) {
+	m, err := s.multipart()
+	if err != nil {
+		return nil, err
+	}
+	expiry := time.Until(session.ExpiresAt)
+	if expiry <= 0 {
+		return nil, ErrUploadNotActive
+	}
+
+	urls := make([]PartURL, 0, len(indices))
+	for _, index := range indices {
+		u, err := m.PresignPart(context.Background(), session.VideoID+"/original.mp4", session.MultipartID, index+1, expiry)
 		if err != nil {
-			return fmt.Errorf("failed to copy chunk %d: %v", i, err)
+			return nil, err
+		}
+		urls = append(urls, PartURL{ChunkIndex: index, PartNumber: index + 1, URL: u})
+	}
+	return urls, nil
+}
+
+func (s *UploadService) listParts(session *models.UploadSession) ([]storage.Part, error) {
+	m, err := s.multipart()
+	if err != nil {
+		return nil, err
+	}
+	return m.ListParts(context.Background(), session.VideoID+"/original.mp4", session.MultipartID)
+}
+
+// partChunks 把分段转换为分片，分段编号从 1 开始
+func partChunks(parts []storage.Part) []ChunkInfo {
+	chunks := make([]ChunkInfo, len(parts))
+	for i, p := range parts {
+		chunks[i] = ChunkInfo{Index: p.PartNumber - 1, Size: p.Size}
+	}
+	return chunks
+}
+
+// StartAssembly 锁定会话并加入合并队列，之后不再接受新的分片
+func (s *UploadService) StartAssembly(session *models.UploadSession) (*models.Job, error) {
+	ok, err := models.TransitionUploadSession(session.ID, models.UploadStateActive, models.UploadStateAssembling)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrUploadNotActive
+	}
+
+	job, err := s.Queue.Enqueue(session.VideoID, models.JobTypeAssemble)
+	if err != nil {
+		models.TransitionUploadSession(session.ID, models.UploadStateAssembling, models.UploadStateActive)
+		return nil, err
+	}
+	return job, nil
+}
+
+// AssembleJob 是合并任务的处理函数
+// 分片只在 original.mp4 就位之后才删除，服务重启后重新执行是安全的
+func (s *UploadService) AssembleJob(job *models.Job) error {
+	session, err := models.GetUploadSession(job.VideoID)
+	if err != nil {
+		return fmt.Errorf("failed to get upload session: %v", err)
+	}
+
+	switch session.State {
+	case models.UploadStateAssembling:
+	case models.UploadStateCompleted:
+		// 上次执行在删除临时目录前后中断
+		return s.ensureTranscodeJob(session.VideoID)
+	default:
+		return fmt.Errorf("upload is %s", session.State)
+	}
+
+	contentHash, err := s.assemble(session)
+	if errors.Is(err, errChecksumMismatch) {
+		// 分片都已通过校验，整个文件仍不一致时重试也没有意义
+		models.TransitionUploadSession(session.ID, models.UploadStateAssembling, models.UploadStateFailed)
+		models.UpdateVideoStatus(session.VideoID, "error")
+		return err
+	}
+	if err != nil {
+		// 允许客户端重新提交合并请求
+		models.TransitionUploadSession(session.ID, models.UploadStateAssembling, models.UploadStateActive)
+		return err
+	}
+
+	if _, err := models.TransitionUploadSession(session.ID, models.UploadStateAssembling, models.UploadStateCompleted); err != nil {
+		return fmt.Errorf("failed to complete upload session: %v", err)
+	}
+	if _, err := s.StartProcessing(session.VideoID, contentHash); err != nil {
+		return err
+	}
+
+	tempDir := filepath.Join(s.BaseDir, session.ID)
+	if err := os.RemoveAll(tempDir); err != nil {
+		log.Printf("Failed to remove temp directory %s: %v", tempDir, err)
+	}
+	return nil
+}
+
+var errChecksumMismatch = errors.New("file checksum mismatch")
+
+// assemble 把分片依次流式写入存储中的 original.mp4
+// 存储后端保证写入是原子的，整个文件校验失败时不会留下 original.mp4
+// 返回合并后文件的 SHA-256，用于内容去重
+func (s *UploadService) assemble(session *models.UploadSession) (string, error) {
+	if session.Mode == models.UploadModeDirect {
+		return s.completeDirect(session)
+	}
+
+	chunks, err := s.ListChunks(session)
+	if err != nil {
+		return "", fmt.Errorf("failed to read temp directory: %v", err)
+	}
+	if missing, received := MissingChunks(session, chunks); len(missing) > 0 || received != session.FileSize {
+		return "", fmt.Errorf("upload is incomplete: %d chunks missing, %d of %d bytes", len(missing), received, session.FileSize)
+	}
+
+	var checksum *Checksum
+	if session.Checksum != "" {
+		if checksum, err = ParseChecksum(session.Checksum); err != nil {
+			return "", fmt.Errorf("invalid stored checksum: %v", err)
 		}
 	}
 
+	contentHash := sha256.New()
+	r := &checksumReader{
+		r:         io.TeeReader(&chunkReader{dir: filepath.Join(s.BaseDir, session.ID), chunks: chunks}, contentHash),
+		checksum:  checksum,
+		remaining: session.FileSize,
+	}
+	if checksum != nil {
+		r.h = checksum.NewHash()
+	}
+
+	err = s.Storage.Put(context.Background(), session.VideoID+"/original.mp4", r, session.FileSize)
+	if r.mismatch {
+		return "", errChecksumMismatch
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to store original file: %v", err)
+	}
+	return hex.EncodeToString(contentHash.Sum(nil)), nil
+}
+
+// completeDirect 合并直传的分段，然后读取一遍合并结果进行校验
+// 上次执行已完成合并时存储后端不再有这个分段上传，直接校验已有的对象
+func (s *UploadService) completeDirect(session *models.UploadSession) (string, error) {
+	ctx := context.Background()
+	key := session.VideoID + "/original.mp4"
+
+	_, err := s.Storage.Stat(ctx, key)
+	if errors.Is(err, storage.ErrNotExist) {
+		m, err := s.multipart()
+		if err != nil {
+			return "", err
+		}
+		parts, err := m.ListParts(ctx, key, session.MultipartID)
+		if err != nil {
+			return "", fmt.Errorf("failed to list uploaded parts: %v", err)
+		}
+		chunks := partChunks(parts)
+		if missing, received := MissingChunks(session, chunks); len(missing) > 0 || received != session.FileSize {
+			return "", fmt.Errorf("upload is incomplete: %d chunks missing, %d of %d bytes", len(missing), received, session.FileSize)
+		}
+		if invalid := InvalidChunks(session, chunks); len(invalid) > 0 {
+			return "", fmt.Errorf("upload has %d chunks of the wrong size", len(invalid))
+		}
+		if err := m.CompleteMultipartUpload(ctx, key, session.MultipartID, parts); err != nil {
+			return "", fmt.Errorf("failed to complete multipart upload: %v", err)
+		}
+	} else if err != nil {
+		return "", err
+	}
+
+	var checksum *Checksum
+	if session.Checksum != "" {
+		if checksum, err = ParseChecksum(session.Checksum); err != nil {
+			return "", fmt.Errorf("invalid stored checksum: %v", err)
+		}
+	}
+	body, err := s.Storage.Get(ctx, key, 0, -1)
+	if err != nil {
+		return "", fmt.Errorf("failed to read original file: %v", err)
+	}
+	defer body.Close()
+
+	contentHash := sha256.New()
+	var w io.Writer = contentHash
+	var h hash.Hash
+	if checksum != nil {
+		h = checksum.NewHash()
+		w = io.MultiWriter(contentHash, h)
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		return "", fmt.Errorf("failed to read original file: %v", err)
+	}
+	if checksum != nil && !checksum.Matches(h) {
+		// 和代理上传一致，校验失败时不保留 original.mp4
+		if err := s.Storage.Delete(ctx, key); err != nil {
+			log.Printf("Failed to delete mismatched upload %s: %v", key, err)
+		}
+		return "", errChecksumMismatch
+	}
+	return hex.EncodeToString(contentHash.Sum(nil)), nil
+}
+
+// chunkReader 按顺序读取各个分片文件，同一时间只打开一个
+type chunkReader struct {
+	dir    string
+	chunks []ChunkInfo
+	cur    *os.File
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if c.cur == nil {
+			if len(c.chunks) == 0 {
+				return 0, io.EOF
+			}
+			f, err := os.Open(filepath.Join(c.dir, c.chunks[0].Name))
+			if err != nil {
+				return 0, fmt.Errorf("failed to open chunk %d: %v", c.chunks[0].Index, err)
+			}
+			c.cur = f
+			c.chunks = c.chunks[1:]
+		}
+
+		n, err := c.cur.Read(p)
+		if err == io.EOF {
+			c.cur.Close()
+			c.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// checksumReader 在读到最后一个字节时校验整个文件，不一致时返回错误使写入失败
+type checksumReader struct {
+	r         io.Reader
+	h         hash.Hash
+	checksum  *Checksum
+	remaining int64
+	mismatch  bool
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if c.h == nil {
+		return n, err
+	}
+	c.h.Write(p[:n])
+	c.remaining -= int64(n)
+	if c.remaining <= 0 && !c.checksum.Matches(c.h) {
+		c.mismatch = true
+		return n, errChecksumMismatch
+	}
+	return n, err
+}
+
+// StartProcessing 在 original.mp4 写入完成后验证文件并加入转码队列
+// contentHash 为空时重新计算。内容与已有媒体相同时直接复用转码结果，返回的任务为 nil
+func (s *UploadService) StartProcessing(videoID, contentHash string) (*models.Job, error) {
+	// 验证文件是否完整
+	ctx := context.Background()
+	key := videoID + "/original.mp4"
+	metadata, err := s.verifyOriginal(ctx, key)
+	if err != nil {
+		models.UpdateVideoStatus(videoID, "error")
+		return nil, fmt.Errorf("file verification failed: %v", err)
+	}
+
+	if contentHash == "" {
+		if contentHash, err = objectSHA256(ctx, s.Storage, key); err != nil {
+			// 会话已完成，不会再有任务处理这个视频
+			models.UpdateVideoStatus(videoID, "error")
+			return nil, fmt.Errorf("failed to hash file: %v", err)
+		}
+	}
+	mediaID, reused, err := models.AttachMedia(videoID, contentHash)
+	if err != nil {
+		models.UpdateVideoStatus(videoID, "error")
+		return nil, fmt.Errorf("failed to record media: %v", err)
+	}
+	if reused {
+		return nil, s.reuseMedia(videoID, mediaID)
+	}
+
+	// 新媒体的目录就是当前视频，复用的媒体已有元数据
+	if err := models.SaveMetadata(mediaID, models.MetadataOriginal, metadata); err != nil {
+		log.Printf("Failed to save metadata of upload %s: %v", videoID, err)
+	}
+
+	// 更新视频状态为 processing
+	if err := models.UpdateVideoStatus(videoID, "processing"); err != nil {
+		return nil, fmt.Errorf("failed to update video status: %v", err)
+	}
+	events.Publish(events.UploadCompleted, videoID, nil)
+
+	// 加入转码队列
+	job, err := s.Queue.Enqueue(videoID, models.JobTypeTranscode)
+	if err != nil {
+		log.Printf("Failed to enqueue transcoding for upload %s: %v", videoID, err)
+		models.UpdateVideoStatus(videoID, "error")
+		return nil, fmt.Errorf("failed to start transcoding: %v", err)
+	}
+	return job, nil
+}
+
+// verifyOriginal 检查原始文件存在且 ffprobe 能读取视频流，返回文件的技术参数
+func (s *UploadService) verifyOriginal(ctx context.Context, key string) (*models.MediaMetadata, error) {
+	info, err := s.Storage.Stat(ctx, key)
+	if errors.Is(err, storage.ErrNotExist) {
+		return nil, fmt.Errorf("file does not exist")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info.Size == 0 {
+		return nil, fmt.Errorf("file is empty")
+	}
+
+	location, err := storage.Locate(ctx, s.Storage, key)
+	if err != nil {
+		return nil, err
+	}
+	return ProbeMetadata(location)
+}
+
+// reuseMedia 删除重复的原始文件，视频直接使用已有媒体的转码结果
+func (s *UploadService) reuseMedia(videoID, mediaID string) error {
+	log.Printf("Video %s has the same content as media %s, skipping transcoding", videoID, mediaID)
+	if err := storage.DeleteAll(context.Background(), s.Storage, videoID+"/"); err != nil {
+		log.Printf("Failed to remove duplicate upload %s: %v", videoID, err)
+	}
+
+	// 已有媒体还在转码时，转码结束后会一起更新这个视频的状态
+	status, err := models.GetMediaStatus(mediaID)
+	if err != nil {
+		return fmt.Errorf("failed to get media status: %v", err)
+	}
+	events.Publish(events.UploadCompleted, videoID, nil)
+	return models.UpdateVideoStatus(videoID, status)
+}
+
+// ensureTranscodeJob 在视频还没有转码任务时补建一个
+func (s *UploadService) ensureTranscodeJob(videoID string) error {
+	video, err := models.GetVideoByID(videoID)
+	if err != nil {
+		return err
+	}
+	if video.MediaID != "" && video.MediaID != videoID {
+		// 复用了已有媒体，不需要转码
+		return nil
+	}
+
+	jobs, err := models.GetJobsByVideoID(videoID)
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		if job.Type == models.JobTypeTranscode {
+			return nil
+		}
+	}
+	_, err = s.StartProcessing(videoID, video.ContentHash)
+	return err
+}
+
+// Abort 中止上传，删除临时文件和未完成的视频记录
+func (s *UploadService) Abort(uploadID string) error {
+	return s.discard(uploadID, models.UploadStateAborted)
+}
+
+// SweepExpired 清理过期的上传会话，以及没有会话记录的旧临时目录
+func (s *UploadService) SweepExpired() (int, error) {
+	sessions, err := models.GetExpiredUploadSessions(time.Now())
+	if err != nil {
+		return 0, fmt.Errorf("failed to get expired sessions: %v", err)
+	}
+
+	expired := 0
+	for _, session := range sessions {
+		err := s.discard(session.ID, models.UploadStateExpired)
+		if errors.Is(err, ErrUploadNotActive) {
+			// 期间已经完成或被中止
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to expire upload %s: %v", session.ID, err)
+			continue
+		}
+		expired++
+	}
+
+	if err := s.removeOrphanDirs(); err != nil {
+		log.Printf("Failed to remove orphaned upload directories: %v", err)
+	}
+	return expired, nil
+}
+
+// discard 先在数据库中更新会话状态，再删除磁盘上的数据
+func (s *UploadService) discard(uploadID, state string) error {
+	session, err := models.GetUploadSession(uploadID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrUploadNotActive
+	}
+	if err != nil {
+		return err
+	}
+
+	ok, err := models.TransitionUploadSession(uploadID, models.UploadStateActive, state)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrUploadNotActive
+	}
+
+	if session.Mode == models.UploadModeDirect {
+		if err := s.CancelDirectUpload(session); err != nil {
+			return fmt.Errorf("failed to abort multipart upload: %v", err)
+		}
+	}
+	if err := os.RemoveAll(filepath.Join(s.BaseDir, uploadID)); err != nil {
+		return fmt.Errorf("failed to remove upload directory: %v", err)
+	}
+	released, err := models.DeleteVideo(session.VideoID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if released != "" {
+		return storage.DeleteAll(context.Background(), s.Storage, released+"/")
+	}
+	return nil
+}
+
+// removeOrphanDirs 删除没有活动会话且超过有效期的临时目录
+func (s *UploadService) removeOrphanDirs() error {
+	entries, err := os.ReadDir(s.BaseDir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < UploadSessionTTL {
+			continue
+		}
+
+		session, err := models.GetUploadSession(entry.Name())
+		if err == nil && (session.State == models.UploadStateActive || session.State == models.UploadStateAssembling) {
+			continue
+		}
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		path := filepath.Join(s.BaseDir, entry.Name())
+		if err := os.RemoveAll(path); err != nil {
+			log.Printf("Failed to remove old temp directory %s: %v", path, err)
+		}
+	}
 	return nil
 }
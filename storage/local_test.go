@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestLocal(t *testing.T) *Local {
+	t.Helper()
+	l, err := NewLocal(filepath.Join(t.TempDir(), "videos"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestLocal(t *testing.T) {
+	testStorage(t, newTestLocal(t))
+}
+
+func TestLocalPutSizeMismatch(t *testing.T) {
+	l := newTestLocal(t)
+	if err := l.Put(t.Context(), "video/clip.mp4", strings.NewReader("short"), 100); err == nil {
+		t.Fatal("Put with wrong size succeeded")
+	}
+	// 失败的写入不留下对象和临时文件
+	entries, err := os.ReadDir(filepath.Join(l.Root, "video"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("left %d files after failed Put", len(entries))
+	}
+}
+
+func TestLocalListSkipsTempFiles(t *testing.T) {
+	l := newTestLocal(t)
+	if err := l.Put(t.Context(), "video/clip.mp4", strings.NewReader("x"), 1); err != nil {
+		t.Fatal(err)
+	}
+	// 模拟写入中途崩溃留下的临时文件
+	if err := os.WriteFile(filepath.Join(l.Root, "video", localTempPrefix+"clip.mp4-1"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	objects, err := l.List(t.Context(), "video/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Key != "video/clip.mp4" {
+		t.Errorf("List = %+v, want only video/clip.mp4", objects)
+	}
+}
+
+func TestLocalDeleteRemovesEmptyDirs(t *testing.T) {
+	l := newTestLocal(t)
+	ctx := t.Context()
+	for _, key := range []string{"video/hls/master.m3u8", "video/clip.mp4"} {
+		if err := l.Put(ctx, key, strings.NewReader("x"), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := l.Delete(ctx, "video/hls/master.m3u8"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(l.Root, "video", "hls")); !os.IsNotExist(err) {
+		t.Errorf("empty directory video/hls not removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(l.Root, "video")); err != nil {
+		t.Errorf("non-empty directory video removed: %v", err)
+	}
+
+	if err := l.Delete(ctx, "video/clip.mp4"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(l.Root, "video")); !os.IsNotExist(err) {
+		t.Errorf("empty directory video not removed: %v", err)
+	}
+	// 根目录本身保留
+	if _, err := os.Stat(l.Root); err != nil {
+		t.Errorf("storage root removed: %v", err)
+	}
+}
+
+func TestLocalMoveFile(t *testing.T) {
+	l := newTestLocal(t)
+	src := filepath.Join(t.TempDir(), "720p.mp4")
+	if err := os.WriteFile(src, []byte("video"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := PutFile(t.Context(), l, "video/720p.mp4", src); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("source file still exists: %v", err)
+	}
+	info, err := l.Stat(t.Context(), "video/720p.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 5 {
+		t.Errorf("size = %d, want 5", info.Size)
+	}
+}
@@ -0,0 +1,34 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// S3 分段上传的限制：除最后一段外每段至少 5MB，最多 10000 段
+const (
+	MinPartSize = 5 * 1024 * 1024
+	MaxParts    = 10000
+)
+
+// Part 是已上传的一个分段，PartNumber 从 1 开始
+type Part struct {
+	PartNumber int
+	ETag       string
+	Size       int64
+}
+
+// MultipartUploader 由支持客户端直传分段的后端实现
+// 客户端用预签名 URL 直接上传分段，不经过本服务
+type MultipartUploader interface {
+	// CreateMultipartUpload 开始一次写入 key 的分段上传，返回分段上传 ID
+	CreateMultipartUpload(ctx context.Context, key string) (string, error)
+	// PresignPart 返回上传第 partNumber 段的 PUT URL
+	PresignPart(ctx context.Context, key, uploadID string, partNumber int, expiry time.Duration) (string, error)
+	// ListParts 返回已上传的分段，按 PartNumber 排序
+	ListParts(ctx context.Context, key, uploadID string) ([]Part, error)
+	// CompleteMultipartUpload 按给定的分段合并出 key 对象
+	CompleteMultipartUpload(ctx context.Context, key, uploadID string, parts []Part) error
+	// AbortMultipartUpload 放弃分段上传并删除已上传的分段，上传不存在时不报错
+	AbortMultipartUpload(ctx context.Context, key, uploadID string) error
+}
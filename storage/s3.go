@@ -0,0 +1,269 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Config 是 S3 兼容存储（AWS S3、MinIO 等）的连接参数
+type S3Config struct {
+	Endpoint  string // 例如 "s3.amazonaws.com" 或 "localhost:9000"
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	UseSSL    bool
+	// Prefix 加在所有 key 前面，多个服务可以共用一个 bucket
+	Prefix string
+	// PresignExpiry 是交给 ffmpeg 读取的预签名 URL 的有效期
+	PresignExpiry time.Duration
+}
+
+// S3 把对象保存在 S3 兼容的 bucket 中
+type S3 struct {
+	client *minio.Client
+	bucket string
+	prefix string
+	expiry time.Duration
+}
+
+// NewS3 连接存储服务，bucket 不存在时自动创建
+func NewS3(cfg S3Config) (*S3, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, fmt.Errorf("S3 endpoint and bucket are required")
+	}
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.UseSSL,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 client: %v", err)
+	}
+
+	ctx := context.Background()
+	exists, err := client.BucketExists(ctx, cfg.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check bucket %s: %v", cfg.Bucket, err)
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, cfg.Bucket, minio.MakeBucketOptions{Region: cfg.Region}); err != nil {
+			return nil, fmt.Errorf("failed to create bucket %s: %v", cfg.Bucket, err)
+		}
+	}
+
+	expiry := cfg.PresignExpiry
+	if expiry <= 0 {
+		// 足够完成一次长视频的转码
+		expiry = 12 * time.Hour
+	}
+	prefix := strings.Trim(cfg.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &S3{client: client, bucket: cfg.Bucket, prefix: prefix, expiry: expiry}, nil
+}
+
+func (s *S3) object(key string) (string, error) {
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+	return s.prefix + key, nil
+}
+
+// mapError 把 NoSuchKey 转换为 ErrNotExist
+func mapError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return ErrNotExist
+	}
+	return err
+}
+
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	name, err := s.object(key)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.PutObject(ctx, s.bucket, name, r, size, minio.PutObjectOptions{
+		ContentType: ContentType(key),
+	})
+	return err
+}
+
+func (s *S3) Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	name, err := s.object(key)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := minio.GetObjectOptions{}
+	switch {
+	case length == 0:
+		return io.NopCloser(strings.NewReader("")), nil
+	case length > 0:
+		err = opts.SetRange(offset, offset+length-1)
+	case offset > 0:
+		err = opts.SetRange(offset, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// GetObject 在第一次读取时才发送请求，先检查对象是否存在以便尽早返回 ErrNotExist
+	// 不能调用 obj.Stat()，它会使后续读取忽略 Range
+	if _, err := s.client.StatObject(ctx, s.bucket, name, minio.StatObjectOptions{}); err != nil {
+		return nil, mapError(err)
+	}
+	obj, err := s.client.GetObject(ctx, s.bucket, name, opts)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	return obj, nil
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	name, err := s.object(key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := s.client.StatObject(ctx, s.bucket, name, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, mapError(err)
+	}
+	return &ObjectInfo{Key: key, Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	name, err := s.object(key)
+	if err != nil {
+		return err
+	}
+	return s.client.RemoveObject(ctx, s.bucket, name, minio.RemoveObjectOptions{})
+}
+
+func (s *S3) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{
+		Prefix:    s.prefix + prefix,
+		Recursive: true,
+	}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		objects = append(objects, ObjectInfo{
+			Key:     strings.TrimPrefix(obj.Key, s.prefix),
+			Size:    obj.Size,
+			ModTime: obj.LastModified,
+		})
+	}
+	return objects, nil
+}
+
+// Locate 返回预签名的 GET URL，ffmpeg 通过 HTTP Range 请求读取
+func (s *S3) Locate(ctx context.Context, key string) (string, error) {
+	name, err := s.object(key)
+	if err != nil {
+		return "", err
+	}
+	u, err := s.client.PresignedGetObject(ctx, s.bucket, name, s.expiry, nil)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+func (s *S3) core() minio.Core {
+	return minio.Core{Client: s.client}
+}
+
+func (s *S3) CreateMultipartUpload(ctx context.Context, key string) (string, error) {
+	name, err := s.object(key)
+	if err != nil {
+		return "", err
+	}
+	return s.core().NewMultipartUpload(ctx, s.bucket, name, minio.PutObjectOptions{
+		ContentType: ContentType(key),
+	})
+}
+
+func (s *S3) PresignPart(ctx context.Context, key, uploadID string, partNumber int, expiry time.Duration) (string, error) {
+	name, err := s.object(key)
+	if err != nil {
+		return "", err
+	}
+	params := url.Values{}
+	params.Set("partNumber", strconv.Itoa(partNumber))
+	params.Set("uploadId", uploadID)
+	u, err := s.client.Presign(ctx, http.MethodPut, s.bucket, name, expiry, params)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+func (s *S3) ListParts(ctx context.Context, key, uploadID string) ([]Part, error) {
+	name, err := s.object(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var parts []Part
+	marker := 0
+	for {
+		result, err := s.core().ListObjectParts(ctx, s.bucket, name, uploadID, marker, 1000)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range result.ObjectParts {
+			parts = append(parts, Part{PartNumber: p.PartNumber, ETag: p.ETag, Size: p.Size})
+		}
+		if !result.IsTruncated {
+			break
+		}
+		marker = result.NextPartNumberMarker
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].PartNumber < parts[j].PartNumber
+	})
+	return parts, nil
+}
+
+func (s *S3) CompleteMultipartUpload(ctx context.Context, key, uploadID string, parts []Part) error {
+	name, err := s.object(key)
+	if err != nil {
+		return err
+	}
+	complete := make([]minio.CompletePart, len(parts))
+	for i, p := range parts {
+		complete[i] = minio.CompletePart{PartNumber: p.PartNumber, ETag: p.ETag}
+	}
+	_, err = s.core().CompleteMultipartUpload(ctx, s.bucket, name, uploadID, complete, minio.PutObjectOptions{
+		ContentType: ContentType(key),
+	})
+	return err
+}
+
+func (s *S3) AbortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	name, err := s.object(key)
+	if err != nil {
+		return err
+	}
+	err = s.core().AbortMultipartUpload(ctx, s.bucket, name, uploadID)
+	if minio.ToErrorResponse(err).Code == minio.NoSuchUpload {
+		return nil
+	}
+	return err
+}
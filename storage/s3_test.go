@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestS3 连接 S3_TEST_ENDPOINT 指定的存储服务（例如本地的 MinIO），未设置时跳过测试
+// 每个测试使用独立的 key 前缀，结束时删除写入的对象
+func newTestS3(t *testing.T) *S3 {
+	t.Helper()
+	endpoint := os.Getenv("S3_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_TEST_ENDPOINT not set")
+	}
+	bucket := os.Getenv("S3_TEST_BUCKET")
+	if bucket == "" {
+		bucket = "video-streaming-test"
+	}
+	s, err := NewS3(S3Config{
+		Endpoint:  endpoint,
+		Region:    os.Getenv("S3_TEST_REGION"),
+		Bucket:    bucket,
+		AccessKey: os.Getenv("S3_TEST_ACCESS_KEY"),
+		SecretKey: os.Getenv("S3_TEST_SECRET_KEY"),
+		UseSSL:    os.Getenv("S3_TEST_USE_SSL") == "true",
+		Prefix:    fmt.Sprintf("test-%d", time.Now().UnixNano()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := DeleteAll(context.Background(), s, ""); err != nil {
+			t.Errorf("failed to clean up: %v", err)
+		}
+	})
+	return s
+}
+
+func TestS3(t *testing.T) {
+	testStorage(t, newTestS3(t))
+}
+
+// uploadPart 像客户端一样用预签名 URL 上传一个分段
+func uploadPart(t *testing.T, s *S3, key, uploadID string, partNumber int, data []byte) {
+	t.Helper()
+	u, err := s.PresignPart(t.Context(), key, uploadID, partNumber, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodPut, u, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("upload part %d: status %d", partNumber, resp.StatusCode)
+	}
+}
+
+func TestS3Multipart(t *testing.T) {
+	s := newTestS3(t)
+	ctx := t.Context()
+	key := "video/original.mp4"
+
+	uploadID, err := s.CreateMultipartUpload(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 除最后一段外每段至少 MinPartSize，分段可以乱序上传
+	first := bytes.Repeat([]byte("a"), MinPartSize)
+	last := []byte("tail")
+	uploadPart(t, s, key, uploadID, 2, last)
+	uploadPart(t, s, key, uploadID, 1, first)
+
+	parts, err := s.ListParts(ctx, key, uploadID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 2 || parts[0].PartNumber != 1 || parts[1].PartNumber != 2 {
+		t.Fatalf("ListParts = %+v, want parts 1 and 2", parts)
+	}
+	if parts[0].Size != int64(len(first)) || parts[1].Size != int64(len(last)) || parts[0].ETag == "" {
+		t.Errorf("ListParts = %+v", parts)
+	}
+
+	if err := s.CompleteMultipartUpload(ctx, key, uploadID, parts); err != nil {
+		t.Fatal(err)
+	}
+	r, err := s.Get(ctx, key, int64(len(first))-1, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "atail" {
+		t.Errorf("object ends with %q, want %q", data, "atail")
+	}
+}
+
+func TestS3AbortMultipart(t *testing.T) {
+	s := newTestS3(t)
+	ctx := t.Context()
+	key := "video/original.mp4"
+
+	uploadID, err := s.CreateMultipartUpload(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadPart(t, s, key, uploadID, 1, []byte("data"))
+	if err := s.AbortMultipartUpload(ctx, key, uploadID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ListParts(ctx, key, uploadID); err == nil {
+		t.Error("ListParts succeeded after abort")
+	}
+	// 重复放弃不报错
+	if err := s.AbortMultipartUpload(ctx, key, uploadID); err != nil {
+		t.Errorf("second abort: %v", err)
+	}
+	if _, err := s.Stat(ctx, key); err == nil {
+		t.Error("aborted upload created an object")
+	}
+}
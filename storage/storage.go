@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrNotExist 表示对象不存在
+var ErrNotExist = errors.New("object does not exist")
+
+// Storage 是媒体文件的存储后端
+// key 是以 "/" 分隔的相对路径，例如 "<videoID>/720p.mp4"
+type Storage interface {
+	// Put 写入对象，size 未知时传 -1。写入是原子的，失败时不会留下不完整的对象
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Get 从 offset 开始读取 length 字节，length 小于 0 表示读到末尾
+	Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+	// Delete 删除对象，对象不存在时不报错
+	Delete(ctx context.Context, key string) error
+	// List 返回 key 以 prefix 开头的所有对象
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+}
+
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Locator 由能给出 ffmpeg 可以直接读取的地址的后端实现
+// 本地后端返回文件路径，S3 后端返回预签名 URL
+type Locator interface {
+	Locate(ctx context.Context, key string) (string, error)
+}
+
+// FileMover 由可以直接移动本地文件的后端实现，避免复制大文件
+type FileMover interface {
+	MoveFile(ctx context.Context, key, localPath string) error
+}
+
+// Locate 返回 ffmpeg 可以读取的对象地址
+func Locate(ctx context.Context, s Storage, key string) (string, error) {
+	l, ok := s.(Locator)
+	if !ok {
+		return "", fmt.Errorf("storage backend cannot locate %s", key)
+	}
+	return l.Locate(ctx, key)
+}
+
+// PutFile 把本地文件移动到存储中，写入成功后删除本地文件
+func PutFile(ctx context.Context, s Storage, key, localPath string) error {
+	if m, ok := s.(FileMover); ok {
+		return m.MoveFile(ctx, key, localPath)
+	}
+
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = s.Put(ctx, key, f, info.Size())
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(localPath)
+}
+
+// PutDir 把本地目录下的所有文件写入存储，key 为 prefix 加上相对路径
+func PutDir(ctx context.Context, s Storage, dir, prefix string) error {
+	return filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		return PutFile(ctx, s, path.Join(prefix, filepath.ToSlash(rel)), p)
+	})
+}
+
+// DeleteAll 删除 key 以 prefix 开头的所有对象
+func DeleteAll(ctx context.Context, s Storage, prefix string) error {
+	objects, err := s.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		if err := s.Delete(ctx, obj.Key); err != nil {
+			return fmt.Errorf("failed to delete %s: %v", obj.Key, err)
+		}
+	}
+	return nil
+}
+
+// checkKey 拒绝绝对路径和包含 ".." 的 key，防止越过存储根目录
+func checkKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return fmt.Errorf("invalid storage key %q", key)
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == ".." || part == "." {
+			return fmt.Errorf("invalid storage key %q", key)
+		}
+	}
+	return nil
+}
+
+// 流媒体文件的 MIME 类型，其余按扩展名推断
+var contentTypes = map[string]string{
+	".mp4":  "video/mp4",
+	".m3u8": "application/vnd.apple.mpegurl",
+	".ts":   "video/mp2t",
+	".m4s":  "video/iso.segment",
+	".mpd":  "application/dash+xml",
+	".vtt":  "text/vtt",
+}
+
+// ContentType 返回 key 对应的 MIME 类型
+func ContentType(key string) string {
+	ext := strings.ToLower(path.Ext(key))
+	if t, ok := contentTypes[ext]; ok {
+		return t
+	}
+	if t := mime.TypeByExtension(ext); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testStorage 对一个空的存储后端运行所有后端都必须满足的约定
+func testStorage(t *testing.T, s Storage) {
+	ctx := t.Context()
+	put := func(key, content string) {
+		t.Helper()
+		if err := s.Put(ctx, key, strings.NewReader(content), int64(len(content))); err != nil {
+			t.Fatalf("Put(%s): %v", key, err)
+		}
+	}
+	put("video/clip.mp4", "hello world")
+	put("video/hls/master.m3u8", "#EXTM3U")
+	put("videos.txt", "x")
+	put("other/clip.mp4", "y")
+
+	t.Run("Get", func(t *testing.T) {
+		tests := []struct {
+			offset, length int64
+			want           string
+		}{
+			{0, -1, "hello world"},
+			{6, -1, "world"},
+			{0, 5, "hello"},
+			{6, 3, "wor"},
+			{4, 0, ""},
+			// 超出末尾的长度只读到末尾
+			{6, 100, "world"},
+		}
+		for _, tt := range tests {
+			r, err := s.Get(ctx, "video/clip.mp4", tt.offset, tt.length)
+			if err != nil {
+				t.Errorf("Get(%d, %d): %v", tt.offset, tt.length, err)
+				continue
+			}
+			data, err := io.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Errorf("Get(%d, %d): read: %v", tt.offset, tt.length, err)
+			} else if string(data) != tt.want {
+				t.Errorf("Get(%d, %d) = %q, want %q", tt.offset, tt.length, data, tt.want)
+			}
+		}
+		if _, err := s.Get(ctx, "video/missing.mp4", 0, -1); !errors.Is(err, ErrNotExist) {
+			t.Errorf("Get missing object: err = %v, want ErrNotExist", err)
+		}
+	})
+
+	t.Run("Stat", func(t *testing.T) {
+		info, err := s.Stat(ctx, "video/clip.mp4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Key != "video/clip.mp4" || info.Size != 11 || info.ModTime.IsZero() {
+			t.Errorf("Stat = %+v", info)
+		}
+		// 目录不是对象
+		for _, key := range []string{"video/missing.mp4", "video/hls"} {
+			if _, err := s.Stat(ctx, key); !errors.Is(err, ErrNotExist) {
+				t.Errorf("Stat(%s): err = %v, want ErrNotExist", key, err)
+			}
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		tests := []struct {
+			prefix string
+			want   []string
+		}{
+			{"video/", []string{"video/clip.mp4", "video/hls/master.m3u8"}},
+			{"video", []string{"video/clip.mp4", "video/hls/master.m3u8", "videos.txt"}},
+			{"video/hls/", []string{"video/hls/master.m3u8"}},
+			{"video/c", []string{"video/clip.mp4"}},
+			{"missing/", nil},
+		}
+		for _, tt := range tests {
+			objects, err := s.List(ctx, tt.prefix)
+			if err != nil {
+				t.Errorf("List(%q): %v", tt.prefix, err)
+				continue
+			}
+			var keys []string
+			for _, obj := range objects {
+				keys = append(keys, obj.Key)
+			}
+			slices.Sort(keys)
+			if !slices.Equal(keys, tt.want) {
+				t.Errorf("List(%q) = %v, want %v", tt.prefix, keys, tt.want)
+			}
+		}
+	})
+
+	t.Run("Overwrite", func(t *testing.T) {
+		put("other/clip.mp4", "replaced")
+		info, err := s.Stat(ctx, "other/clip.mp4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size != int64(len("replaced")) {
+			t.Errorf("size after overwrite = %d, want %d", info.Size, len("replaced"))
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		if err := s.Delete(ctx, "video/hls/master.m3u8"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Stat(ctx, "video/hls/master.m3u8"); !errors.Is(err, ErrNotExist) {
+			t.Errorf("Stat after Delete: err = %v, want ErrNotExist", err)
+		}
+		// 删除不存在的对象不报错
+		if err := s.Delete(ctx, "video/hls/master.m3u8"); err != nil {
+			t.Errorf("second Delete: %v", err)
+		}
+		if err := DeleteAll(ctx, s, "video/"); err != nil {
+			t.Fatal(err)
+		}
+		objects, err := s.List(ctx, "video")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(objects) != 1 || objects[0].Key != "videos.txt" {
+			t.Errorf("objects after DeleteAll = %+v, want only videos.txt", objects)
+		}
+	})
+
+	t.Run("InvalidKey", func(t *testing.T) {
+		for _, key := range []string{"../escape", "video/../../escape", "/abs"} {
+			if err := s.Put(ctx, key, strings.NewReader("x"), 1); err == nil {
+				t.Errorf("Put(%q) succeeded", key)
+			}
+			if _, err := s.Get(ctx, key, 0, -1); err == nil || errors.Is(err, ErrNotExist) {
+				t.Errorf("Get(%q): err = %v, want invalid key", key, err)
+			}
+		}
+	})
+}
+
+func TestCheckKey(t *testing.T) {
+	tests := []struct {
+		key   string
+		valid bool
+	}{
+		{"video/720p.mp4", true},
+		{"video/hls/master.m3u8", true},
+		{"video/..hidden", true},
+		{"", false},
+		{"/etc/passwd", false},
+		{"..", false},
+		{"../video", false},
+		{"video/../../etc", false},
+		{"video/./720p.mp4", false},
+		{`video\720p.mp4`, false},
+	}
+	for _, tt := range tests {
+		if err := checkKey(tt.key); (err == nil) != tt.valid {
+			t.Errorf("checkKey(%q) = %v, want valid %v", tt.key, err, tt.valid)
+		}
+	}
+}
+
+func TestContentType(t *testing.T) {
+	tests := []struct {
+		key, want string
+	}{
+		{"video/720p.mp4", "video/mp4"},
+		{"video/hls/master.M3U8", "application/vnd.apple.mpegurl"},
+		{"video/cmaf/chunk-0-00001.m4s", "video/iso.segment"},
+		{"video/thumbnail.jpg", "image/jpeg"},
+		{"video/unknown", "application/octet-stream"},
+	}
+	for _, tt := range tests {
+		if got := ContentType(tt.key); got != tt.want {
+			t.Errorf("ContentType(%s) = %s, want %s", tt.key, got, tt.want)
+		}
+	}
+}